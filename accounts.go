@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultAccountID = "default"
+
+var (
+	accountIDPattern   = regexp.MustCompile(`^[a-z0-9-]+$`)
+	errAccountNotFound = fmt.Errorf("Account not found")
+	errAccountPending  = fmt.Errorf("Account has operations waiting in the outbox, remove it once they were executed")
+)
+
+// Account is a HabitRPG user the scheduler manages tasks for. Every account
+// has its own credentials and its tasks are stored in a separate Redis key.
+// The API token is only persisted encrypted with the master key.
+type Account struct {
+	ID   string
+	Name string
+
+	HabitRPGUserID    string
+	HabitRPGAPIToken  string `json:"-"`
+	EncryptedAPIToken string `json:",omitempty"`
+}
+
+// storedAccount is used to read accounts persisted before tokens were
+// encrypted which contain the token as plaintext
+type storedAccount struct {
+	Account
+	PlaintextAPIToken string `json:"HabitRPGAPIToken,omitempty"`
+}
+
+// accountView is the representation of an account in API responses which
+// never contains the token itself
+type accountView struct {
+	ID             string
+	Name           string
+	HabitRPGUserID string
+	HasAPIToken    bool
+}
+
+func (a Account) view() accountView {
+	return accountView{
+		ID:             a.ID,
+		Name:           a.Name,
+		HabitRPGUserID: a.HabitRPGUserID,
+		HasAPIToken:    a.HabitRPGAPIToken != "",
+	}
+}
+
+// decryptToken sets the HabitRPGAPIToken from the stored representation and
+// reports whether the stored value needs to be encrypted (again) using the
+// current master key
+func (a *Account) decryptToken(stored storedAccount) (bool, error) {
+	switch {
+	case stored.EncryptedAPIToken != "":
+		if credentialCipher == nil {
+			return false, fmt.Errorf("Account %s has an encrypted API token but no master key is configured", a.ID)
+		}
+		token, err := credentialCipher.Decrypt(stored.EncryptedAPIToken, a.ID)
+		if err != nil {
+			return false, fmt.Errorf("Account %s: %s", a.ID, err)
+		}
+		a.HabitRPGAPIToken = token
+		return credentialCipher.NeedsRotation(stored.EncryptedAPIToken), nil
+
+	case stored.PlaintextAPIToken != "":
+		if credentialCipher == nil {
+			return false, fmt.Errorf("Account %s has an unencrypted API token stored, configure a master key to encrypt it", a.ID)
+		}
+		a.HabitRPGAPIToken = stored.PlaintextAPIToken
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// encryptToken updates the EncryptedAPIToken from the HabitRPGAPIToken
+func (a *Account) encryptToken() error {
+	if a.HabitRPGAPIToken == "" {
+		a.EncryptedAPIToken = ""
+		return nil
+	}
+
+	if credentialCipher == nil {
+		return fmt.Errorf("A master key is required to store HabitRPG API tokens")
+	}
+
+	enc, err := credentialCipher.Encrypt(a.HabitRPGAPIToken, a.ID)
+	if err != nil {
+		return err
+	}
+	a.EncryptedAPIToken = enc
+	return nil
+}
+
+// AccountRegistry holds all known accounts and the task stores belonging to
+// them. The list of accounts is persisted next to the task stores.
+type AccountRegistry struct {
+	Accounts []Account
+
+	storage storage
+	stores  map[string]*HabitTaskStore
+	lock    sync.RWMutex
+}
+
+func NewAccountRegistry(storage storage) *AccountRegistry {
+	return &AccountRegistry{
+		Accounts: []Account{},
+		storage:  storage,
+		stores:   map[string]*HabitTaskStore{},
+	}
+}
+
+// storeKeyForAccount returns the Redis key holding the tasks of the account.
+// The default account uses the key from before accounts were introduced.
+func storeKeyForAccount(id string) string {
+	if id == defaultAccountID {
+		return config.RedisStoreKey
+	}
+	return config.RedisStoreKey + ":account:" + id
+}
+
+func registryKey() string {
+	return config.RedisStoreKey + ":accounts"
+}
+
+// Load reads the list of accounts and loads the task stores of all accounts.
+// The default account is always present and uses the credentials given by
+// flags if there are any.
+func (a *AccountRegistry) Load() error {
+	data, err := a.storage.Get(registryKey())
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+
+	stored := struct{ Accounts []storedAccount }{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	needsSave := false
+	accs := []Account{}
+	for _, sa := range stored.Accounts {
+		acc := sa.Account
+		reencrypt, err := acc.decryptToken(sa)
+		if err != nil {
+			return err
+		}
+		if reencrypt {
+			if err := acc.encryptToken(); err != nil {
+				return err
+			}
+			needsSave = true
+		}
+		accs = append(accs, acc)
+	}
+
+	var def *Account
+	for i := range accs {
+		if accs[i].ID == defaultAccountID {
+			def = &accs[i]
+		}
+	}
+	if def == nil {
+		accs = append(accs, Account{ID: defaultAccountID, Name: "Default"})
+		def = &accs[len(accs)-1]
+	}
+	if config.HabitRPGUserID != "" {
+		// Credentials given by flags are not persisted
+		def.HabitRPGUserID = config.HabitRPGUserID
+		def.HabitRPGAPIToken = config.HabitRPGAPIToken
+		def.EncryptedAPIToken = ""
+	}
+
+	// Stores of known accounts are loaded in place as handlers and jobs
+	// might still hold them
+	stores := map[string]*HabitTaskStore{}
+	for _, acc := range accs {
+		store := a.stores[acc.ID]
+		if store == nil {
+			store = NewHabitTaskStore(a.storage, acc)
+		} else {
+			store.SetCredentials(acc.HabitRPGUserID, acc.HabitRPGAPIToken)
+		}
+		if err := store.Load(); err != nil {
+			return fmt.Errorf("Unable to load tasks for account %s: %s", acc.ID, err)
+		}
+		stores[acc.ID] = store
+	}
+	a.Accounts, a.stores = accs, stores
+
+	if needsSave && isLeader() {
+		// Tokens were encrypted with a previous master key or not at all,
+		// store them encrypted with the current key right away
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		if err := a.storage.Set(registryKey(), data); err != nil {
+			return err
+		}
+		log.Printf("Encrypted stored HabitRPG API tokens with the current master key")
+	}
+
+	return nil
+}
+
+// Save persists the list of accounts
+func (a *AccountRegistry) Save() error {
+	a.lock.RLock()
+	data, err := json.Marshal(a)
+	a.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return a.storage.Set(registryKey(), data)
+}
+
+// SaveAll persists the list of accounts and the tasks of every account
+func (a *AccountRegistry) SaveAll() error {
+	if err := a.Save(); err != nil {
+		return err
+	}
+
+	for _, store := range a.Stores() {
+		if err := store.Save(); err != nil {
+			return fmt.Errorf("Account %s: %s", store.accountID, err)
+		}
+	}
+
+	return nil
+}
+
+// Reload replaces all accounts and the tasks of their stores with the state
+// stored in Redis, used by followers to keep up with the changes made by the
+// leader
+func (a *AccountRegistry) Reload() error {
+	return a.Load()
+}
+
+// Store returns the task store of the account or nil if there is no such account
+func (a *AccountRegistry) Store(id string) *HabitTaskStore {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.stores[id]
+}
+
+// Stores returns the task stores of all accounts ordered by account ID
+func (a *AccountRegistry) Stores() []*HabitTaskStore {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	stores := []*HabitTaskStore{}
+	for _, store := range a.stores {
+		stores = append(stores, store)
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].accountID < stores[j].accountID })
+
+	return stores
+}
+
+// List returns all accounts without their tokens
+func (a *AccountRegistry) List() []accountView {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	accounts := []accountView{}
+	for _, acc := range a.Accounts {
+		accounts = append(accounts, acc.view())
+	}
+	return accounts
+}
+
+// Settings returns the settings of the account contained in exports
+func (a *AccountRegistry) Settings(id string) *AccountSettings {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, acc := range a.Accounts {
+		if acc.ID == id {
+			return &AccountSettings{Name: acc.Name, HabitRPGUserID: acc.HabitRPGUserID}
+		}
+	}
+	return nil
+}
+
+// ApplySettings restores the settings of an import. The HabitRPG user is kept
+// as its API token is not part of the export.
+func (a *AccountRegistry) ApplySettings(id string, settings AccountSettings) error {
+	a.lock.Lock()
+	found := false
+	for i := range a.Accounts {
+		if a.Accounts[i].ID == id {
+			a.Accounts[i].Name = settings.Name
+			found = true
+		}
+	}
+	a.lock.Unlock()
+
+	if !found {
+		return errAccountNotFound
+	}
+	return a.Save()
+}
+
+// Put creates the account or updates name and credentials of an existing one.
+// When updating an empty HabitRPGAPIToken keeps the stored token.
+func (a *AccountRegistry) Put(acc Account) (created bool, err error) {
+	if !accountIDPattern.MatchString(acc.ID) {
+		return false, fmt.Errorf("Account ID must match %s", accountIDPattern)
+	}
+	if acc.HabitRPGUserID == "" {
+		return false, fmt.Errorf("HabitRPGUserID is required")
+	}
+
+	a.lock.Lock()
+	for i := range a.Accounts {
+		if a.Accounts[i].ID == acc.ID {
+			if acc.HabitRPGAPIToken == "" {
+				acc.HabitRPGAPIToken = a.Accounts[i].HabitRPGAPIToken
+			}
+			if err := acc.encryptToken(); err != nil {
+				a.lock.Unlock()
+				return false, err
+			}
+			a.Accounts[i] = acc
+			a.stores[acc.ID].SetCredentials(acc.HabitRPGUserID, acc.HabitRPGAPIToken)
+			a.lock.Unlock()
+			rearmSchedulerAccount(acc.ID)
+			return false, a.Save()
+		}
+	}
+
+	if acc.HabitRPGAPIToken == "" {
+		a.lock.Unlock()
+		return false, fmt.Errorf("HabitRPGAPIToken is required")
+	}
+	if err := acc.encryptToken(); err != nil {
+		a.lock.Unlock()
+		return false, err
+	}
+
+	store := NewHabitTaskStore(a.storage, acc)
+	if err := store.Load(); err != nil {
+		a.lock.Unlock()
+		return false, err
+	}
+	a.Accounts = append(a.Accounts, acc)
+	a.stores[acc.ID] = store
+	a.lock.Unlock()
+	rearmSchedulerAccount(acc.ID)
+
+	return true, a.Save()
+}
+
+// Remove deletes the account including all of its tasks. Accounts having
+// operations in the outbox are not removed as the todos they create, update
+// or delete would be left behind in HabitRPG.
+func (a *AccountRegistry) Remove(id string) error {
+	if id == defaultAccountID {
+		return fmt.Errorf("The default account can not be removed")
+	}
+
+	a.lock.Lock()
+	store := a.stores[id]
+	if store != nil {
+		// Keep the store locked until it is removed so no operation can be
+		// enqueued in between
+		store.lock.Lock()
+		if len(store.Outbox) > 0 {
+			store.lock.Unlock()
+			a.lock.Unlock()
+			return errAccountPending
+		}
+	}
+
+	found := false
+	tmp := []Account{}
+	for _, acc := range a.Accounts {
+		if acc.ID == id {
+			found = true
+			continue
+		}
+		tmp = append(tmp, acc)
+	}
+	a.Accounts = tmp
+	delete(a.stores, id)
+	if store != nil {
+		store.lock.Unlock()
+	}
+	a.lock.Unlock()
+
+	if !found {
+		return errAccountNotFound
+	}
+	rearmSchedulerAccount(id)
+
+	if err := a.Save(); err != nil {
+		return err
+	}
+
+	return a.storage.Del(storeKeyForAccount(id))
+}
+
+func handleGetAccounts(res http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(accounts.List())
+
+	res.Header().Add("Content-Type", "application/json")
+	res.Write(data)
+}
+
+func handlePutAccount(res http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Name             string
+		HabitRPGUserID   string
+		HabitRPGAPIToken string
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(res, fmt.Sprintf("Could not deserialize JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	acc := Account{
+		ID:               mux.Vars(r)["accountid"],
+		Name:             input.Name,
+		HabitRPGUserID:   input.HabitRPGUserID,
+		HabitRPGAPIToken: input.HabitRPGAPIToken,
+	}
+
+	created, err := accounts.Put(acc)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	http.Error(res, "OK", status)
+}
+
+func handleDeleteAccount(res http.ResponseWriter, r *http.Request) {
+	switch err := accounts.Remove(mux.Vars(r)["accountid"]); err {
+	case nil:
+		http.Error(res, "OK", http.StatusOK)
+	case errAccountNotFound:
+		http.Error(res, err.Error(), http.StatusNotFound)
+	case errAccountPending:
+		http.Error(res, err.Error(), http.StatusConflict)
+	default:
+		http.Error(res, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+)
+
+func newTestStorage(t *testing.T) storage {
+	t.Helper()
+
+	st, err := openJournalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.Close)
+	return st
+}
+
+func newTestRegistry(t *testing.T, st storage) *AccountRegistry {
+	t.Helper()
+
+	a := NewAccountRegistry(st)
+	if err := a.Load(); err != nil {
+		t.Fatalf("Unable to load accounts: %s", err)
+	}
+	return a
+}
+
+func TestRemoveAccountWithPendingOperations(t *testing.T) {
+	withMasterKeys(t, testMasterKey)
+	a := newTestRegistry(t, newTestStorage(t))
+
+	if _, err := a.Put(Account{ID: "alice", HabitRPGUserID: "user", HabitRPGAPIToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := a.Store("alice")
+	store.lock.Lock()
+	store.enqueue(OutboxOperation{Kind: outboxDelete, TaskID: "a", TodoID: "todo"})
+	store.lock.Unlock()
+
+	if err := a.Remove("alice"); err != errAccountPending {
+		t.Fatalf("Expected account with pending operations to be kept, got %v", err)
+	}
+	if a.Store("alice") == nil {
+		t.Fatal("Store of the account was removed")
+	}
+
+	store.lock.Lock()
+	store.Outbox = nil
+	store.lock.Unlock()
+
+	if err := a.Remove("alice"); err != nil {
+		t.Fatalf("Removing the account failed: %s", err)
+	}
+	if a.Store("alice") != nil || len(a.List()) != 1 {
+		t.Errorf("Account was not removed: %+v", a.List())
+	}
+}
+
+func TestReloadKeepsStores(t *testing.T) {
+	withMasterKeys(t, testMasterKey)
+	// Leader and follower share the storage like replicas share Redis
+	st := newTestStorage(t)
+
+	leader := newTestRegistry(t, st)
+	if _, err := leader.Put(Account{ID: "alice", HabitRPGUserID: "user", HabitRPGAPIToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	follower := newTestRegistry(t, st)
+	store := follower.Store("alice")
+
+	leaderStore := leader.Store("alice")
+	leaderStore.lock.Lock()
+	leaderStore.Tasks = []HabitTask{dueTestTask("a", "Water plants")}
+	leaderStore.lock.Unlock()
+	if err := leader.SaveAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := follower.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if follower.Store("alice") != store {
+		t.Fatal("Reload replaced the store of the account")
+	}
+	store.lock.RLock()
+	tasks := len(store.Tasks)
+	store.lock.RUnlock()
+	if tasks != 1 {
+		t.Fatalf("Store was not reloaded, %d tasks", tasks)
+	}
+
+	if err := leader.Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if follower.Store("alice") != nil {
+		t.Error("Removed account is still present after reload")
+	}
+}
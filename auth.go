@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+var scopeLevel = map[string]int{
+	scopeRead:  1,
+	scopeWrite: 2,
+	scopeAdmin: 3,
+}
+
+type apiToken struct {
+	Scope   string
+	Account string
+}
+
+type contextKey int
+
+const accountContextKey contextKey = iota
+
+// apiTokens maps the configured bearer tokens to their scope and account. If
+// it is empty the API is not protected.
+var apiTokens = map[string]apiToken{}
+
+// loadAPITokens reads the tokens from the --api-token flag and the file given
+// in --api-token-file. Both use the format "token[:scope[:account]]" with one
+// token per flag value or line, the scope defaults to write and the account to
+// the default account.
+func loadAPITokens() error {
+	entries := append([]string{}, config.APITokens...)
+
+	if config.APITokenFile != "" {
+		f, err := os.Open(config.APITokenFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			entries = append(entries, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			// Unset string slice flags contain one empty element
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) > 3 {
+			return fmt.Errorf("API token must have format token[:scope[:account]]")
+		}
+
+		token, t := parts[0], apiToken{Scope: scopeWrite, Account: defaultAccountID}
+		if len(parts) > 1 {
+			t.Scope = parts[1]
+		}
+		if len(parts) > 2 {
+			t.Account = parts[2]
+		}
+
+		if token == "" {
+			return fmt.Errorf("API token with empty secret configured")
+		}
+		if _, ok := scopeLevel[t.Scope]; !ok {
+			return fmt.Errorf("Unknown scope %q for API token", t.Scope)
+		}
+
+		apiTokens[token] = t
+	}
+
+	return nil
+}
+
+// requiredScope determines which scope is needed to execute the request:
+// managing accounts, the webhook log and the metrics spanning all accounts
+// need admin access, reading requests and schedule previews only need read
+// access
+func requiredScope(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/accounts"), strings.HasPrefix(r.URL.Path, "/v1/webhooks"), r.URL.Path == "/metrics":
+		return scopeAdmin
+	case !isWriteRequest(r):
+		return scopeRead
+	default:
+		return scopeWrite
+	}
+}
+
+// requestToken returns the configured token matching the bearer token sent
+// with the request
+func requestToken(r *http.Request) (apiToken, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return apiToken{}, false
+	}
+	sent := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+
+	var (
+		match apiToken
+		found bool
+	)
+	for token, t := range apiTokens {
+		if subtle.ConstantTimeCompare(sent, []byte(token)) == 1 {
+			match, found = t, true
+		}
+	}
+	return match, found
+}
+
+// requireAPIToken rejects requests without a token having the scope required
+// for the request as long as at least one token is configured and binds the
+// request to the account of the token. Without configured tokens all requests
+// are bound to the default account and requests needing admin scope are
+// rejected, they span all accounts and need an admin token to be configured.
+func requireAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		account := defaultAccountID
+
+		switch {
+		case len(apiTokens) == 0 && requiredScope(r) == scopeAdmin:
+			http.Error(res, "Configure an API token with admin scope to use this request", http.StatusForbidden)
+			return
+
+		case len(apiTokens) > 0:
+			t, ok := requestToken(r)
+			switch {
+			case !ok:
+				res.Header().Set("WWW-Authenticate", `Bearer realm="habitscheduler"`)
+				http.Error(res, "Unauthorized", http.StatusUnauthorized)
+				return
+			case scopeLevel[t.Scope] < scopeLevel[requiredScope(r)]:
+				http.Error(res, fmt.Sprintf("Token needs %s scope for this request", requiredScope(r)), http.StatusForbidden)
+				return
+			}
+			account = t.Account
+		}
+
+		next.ServeHTTP(res, r.WithContext(context.WithValue(r.Context(), accountContextKey, account)))
+	})
+}
+
+type storeHandlerFunc func(store *HabitTaskStore, res http.ResponseWriter, r *http.Request)
+
+// withStore resolves the task store of the account the request is bound to
+// and passes it to the handler
+func withStore(h storeHandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		account, _ := r.Context().Value(accountContextKey).(string)
+
+		store := accounts.Store(account)
+		if store == nil {
+			http.Error(res, "Account of this token does not exist", http.StatusForbidden)
+			return
+		}
+
+		h(store, res, r)
+	}
+}
+
+// corsOriginAllowed checks the origin against the --cors-origin allowlist
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range config.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimRight(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
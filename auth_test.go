@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPITokenAdminRequests(t *testing.T) {
+	saved := apiTokens
+	t.Cleanup(func() { apiTokens = saved })
+
+	ok := requireAPIToken(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	}))
+
+	for _, c := range []struct {
+		tokens map[string]apiToken
+		token  string
+		method string
+		path   string
+		status int
+	}{
+		// Without tokens the tasks API is open but admin requests are refused
+		{nil, "", "GET", "/v1/tasks", http.StatusOK},
+		{nil, "", "POST", "/v1/tasks", http.StatusOK},
+		{nil, "", "GET", "/v1/accounts", http.StatusForbidden},
+		{nil, "", "PUT", "/v1/accounts/alice", http.StatusForbidden},
+		{nil, "", "GET", "/v1/webhooks/deliveries", http.StatusForbidden},
+		{nil, "", "GET", "/metrics", http.StatusForbidden},
+
+		{map[string]apiToken{"w": {scopeWrite, defaultAccountID}}, "w", "GET", "/metrics", http.StatusForbidden},
+		{map[string]apiToken{"a": {scopeAdmin, defaultAccountID}}, "", "GET", "/metrics", http.StatusUnauthorized},
+		{map[string]apiToken{"a": {scopeAdmin, defaultAccountID}}, "a", "GET", "/metrics", http.StatusOK},
+		{map[string]apiToken{"a": {scopeAdmin, defaultAccountID}}, "a", "GET", "/v1/accounts", http.StatusOK},
+	} {
+		apiTokens = c.tokens
+		if apiTokens == nil {
+			apiTokens = map[string]apiToken{}
+		}
+
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		res := httptest.NewRecorder()
+		ok.ServeHTTP(res, r)
+
+		if res.Code != c.status {
+			t.Errorf("%s %s with %d tokens: expected status %d, got %d", c.method, c.path, len(c.tokens), c.status, res.Code)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+)
+
+// habiticaBreaker is shared by the clients of all accounts as an outage of
+// HabitRPG affects all of them. It is nil outside of the server.
+var habiticaBreaker *habitrpg.Breaker
+
+func newHabiticaBreaker() *habitrpg.Breaker {
+	b := habitrpg.NewBreaker(config.HabitBreakerFailures, config.HabitBreakerOpen)
+	b.Probe = habitrpg.NewClient("", "").Status
+	b.OnChange = func(state string) {
+		log.Printf("HabitRPG circuit breaker is %s", state)
+		metricBreakerTransitions.Inc(state)
+
+		if state == habitrpg.BreakerClosed {
+			// Create the occurrences which became due during the outage
+			// right away instead of waiting for their next attempt
+			outbox.retryNow()
+		}
+	}
+	return b
+}
+
+// habiticaAvailable reports whether requests to HabitRPG are sent, while the
+// breaker is open due occurrences are only queued in the outbox
+func habiticaAvailable() bool {
+	return habiticaBreaker == nil || habiticaBreaker.Closed()
+}
+
+func handleHabiticaStatus(res http.ResponseWriter, r *http.Request) {
+	status := habitrpg.BreakerStatus{State: habitrpg.BreakerClosed}
+	if habiticaBreaker != nil {
+		status = habiticaBreaker.Status()
+	}
+
+	data, _ := json.Marshal(status)
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(data)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+)
+
+func TestHabiticaBreakerClosedRetriesOutbox(t *testing.T) {
+	saved := outbox
+	t.Cleanup(func() { outbox = saved })
+
+	for _, c := range []struct {
+		state string
+		retry bool
+	}{
+		{habitrpg.BreakerOpen, false},
+		{habitrpg.BreakerHalfOpen, false},
+		{habitrpg.BreakerClosed, true},
+	} {
+		outbox = &outboxWorker{kick: make(chan struct{}, 1), stop: make(chan struct{})}
+		newHabiticaBreaker().OnChange(c.state)
+
+		kicked := len(outbox.kick) == 1
+		if forced := outbox.force.Load(); forced != c.retry || kicked != c.retry {
+			t.Errorf("State %s: expected retry %v, got force %v, kick %v", c.state, c.retry, forced, kicked)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Luzifer/rconfig"
+)
+
+// cliExport fetches an export of the tasks from the running server and
+// writes it to the file given as first argument or to stdout if no file was
+// given
+func cliExport(args []string) {
+	data := json.RawMessage{}
+	if err := cliAPIRequest("GET", "/export", nil, &data); err != nil {
+		log.Printf("Unable to export: %s", err)
+		os.Exit(1)
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+
+	if err := ioutil.WriteFile(args[0], data, 0600); err != nil {
+		log.Printf("Unable to write export: %s", err)
+		os.Exit(1)
+	}
+}
+
+// cliImport reads an export from the file given as first argument or from
+// stdin if no file was given and sends it to the running server
+func cliImport(args []string) {
+	var (
+		data []byte
+		err  error
+	)
+
+	if len(args) == 0 || args[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		log.Printf("Unable to read import: %s", err)
+		os.Exit(1)
+	}
+
+	params := url.Values{"mode": {config.ImportMode}, "on_conflict": {config.ImportConflict}}
+	result := ImportResult{}
+	if err := cliAPIRequest("POST", "/import?"+params.Encode(), bytes.NewReader(data), &result); err != nil {
+		log.Printf("Unable to import: %s", err)
+		os.Exit(1)
+	}
+
+	log.Printf("Import (%s): %d created, %d replaced, %d skipped, %d history records added",
+		result.Mode, len(result.Created), len(result.Replaced), len(result.Skipped), result.History)
+	if result.Settings != nil {
+		log.Printf("Restored settings of the account")
+	}
+}
+
+// cliTasks implements the "tasks" subcommands talking to the HTTP API of a
+// running server
+func cliTasks(args []string) {
+	if len(args) == 0 {
+		cliUsage()
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = cliTasksList(false, args[1:])
+	case "upcoming":
+		err = cliTasksList(true, args[1:])
+	case "add":
+		err = cliTasksAdd(args[1:])
+	case "rm":
+		err = cliTasksAction("DELETE", "", args[1:])
+	case "trigger":
+		err = cliTasksAction("POST", "/trigger", args[1:])
+	case "pause":
+		err = cliTasksAction("POST", "/pause", args[1:])
+	case "resume":
+		err = cliTasksAction("POST", "/resume", args[1:])
+	case "complete":
+		err = cliTasksAction("POST", "/complete", args[1:])
+	default:
+		cliUsage()
+	}
+
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
+	}
+}
+
+func cliUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] <command>
+
+Commands:
+  serve                          Run the scheduler and its API (default)
+  export [file]                  Write an export of the tasks of the server to
+                                 file or stdout
+  import [file]                  Send an export from file or stdin to the server
+  rotate-key                     Re-encrypt stored HabitRPG API tokens using
+                                 --master-key (old key in --previous-master-key)
+  tasks list                     List all tasks of the server
+  tasks upcoming [n]             List the next n (default all) tasks to become due
+  tasks add <title> <schedule> [todo]
+                                 Create a task, schedule is either a number of
+                                 hours or a cron entry ("0 0 8 1,14 * *"), todo
+                                 is the ID or alias of an existing HabitRPG todo
+                                 to use as the open occurrence, prints the ID
+                                 of the created task
+  tasks rm <id>...               Delete tasks
+  tasks trigger <id>...          Schedule tasks to be created now
+  tasks pause <id>...            Stop creating new occurrences for tasks
+  tasks resume <id>...           Resume paused tasks
+  tasks complete <id>...         Complete the open todos of tasks in HabitRPG
+
+`, os.Args[0])
+	rconfig.Usage()
+	os.Exit(1)
+}
+
+func cliAPIRequest(method, path string, body io.Reader, target interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimRight(config.Server, "/")+"/v1"+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Server responded with status %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if target == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(target)
+}
+
+func cliTasksList(upcoming bool, args []string) error {
+	tasks := []HabitTask{}
+	if err := cliAPIRequest("GET", "/tasks", nil, &tasks); err != nil {
+		return err
+	}
+
+	if upcoming {
+		open := []HabitTask{}
+		for _, t := range tasks {
+			if t.IsCompleted && !t.IsPaused {
+				open = append(open, t)
+			}
+		}
+		tasks = open
+
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].NextEntryDate.Before(tasks[j].NextEntryDate) })
+
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("Invalid number of tasks %q", args[0])
+			}
+			if n < len(tasks) {
+				tasks = tasks[:n]
+			}
+		}
+	}
+
+	if config.Output == "json" {
+		data, err := json.MarshalIndent(tasks, "", "  ")
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(append(data, '\n'))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tSCHEDULE\tNEXT ENTRY\tSTATE")
+	for _, t := range tasks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Title, t.scheduleString(), t.NextEntryDate.Local().Format("2006-01-02 15:04"), t.stateString())
+	}
+	return w.Flush()
+}
+
+func cliTasksAdd(args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		cliUsage()
+	}
+
+	task := struct {
+		HabitTask
+		LinkTodo string `json:",omitempty"`
+	}{HabitTask: HabitTask{Title: args[0]}}
+	if hours, err := strconv.Atoi(args[1]); err == nil {
+		task.RepeatHours = hours
+	} else {
+		task.RepeatCron = true
+		task.RepeatCronEntry = args[1]
+	}
+	if len(args) == 3 {
+		task.LinkTodo = args[2]
+	}
+
+	body, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	created := HabitTask{}
+	if err := cliAPIRequest("POST", "/tasks", bytes.NewReader(body), &created); err != nil {
+		return err
+	}
+
+	fmt.Println(created.ID)
+	return nil
+}
+
+func cliTasksAction(method, suffix string, ids []string) error {
+	if len(ids) == 0 {
+		cliUsage()
+	}
+
+	for _, id := range ids {
+		if err := cliAPIRequest(method, "/tasks/"+url.PathEscape(id)+suffix, nil, nil); err != nil {
+			return fmt.Errorf("Task %s: %s", id, err)
+		}
+		fmt.Printf("%s: OK\n", id)
+	}
+
+	return nil
+}
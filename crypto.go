@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	encryptedValuePrefix = "v1"
+
+	// The master key is used as key material for HKDF and therefore needs to
+	// be random, passphrases are not stretched
+	minMasterKeyLength = 32
+
+	credentialSaltSize = 16
+	credentialKeyInfo  = "habitscheduler credential encryption"
+	credentialIDInfo   = "habitscheduler master key id"
+)
+
+// credentialCipher encrypts the HabitRPG API tokens stored for accounts. It
+// is nil if no master key is configured.
+var credentialCipher *keyring
+
+// keyring holds the current master key used for encryption and previous
+// master keys still accepted for decryption during a key rotation. Every
+// value is encrypted with its own key derived from the master key and a
+// random salt stored with the value.
+type keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// loadCredentialCipher initializes the credentialCipher from --master-key,
+// --master-key-file and --previous-master-key
+func loadCredentialCipher() error {
+	current := config.MasterKey
+	if config.MasterKeyFile != "" {
+		data, err := ioutil.ReadFile(config.MasterKeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read master key file: %s", err)
+		}
+		current = strings.TrimSpace(string(data))
+	}
+
+	if current == "" {
+		return nil
+	}
+	if len(current) < minMasterKeyLength {
+		return fmt.Errorf("Master key must be a random string of at least %d characters", minMasterKeyLength)
+	}
+
+	k := &keyring{keys: map[string][]byte{}}
+
+	var err error
+	if k.current, err = k.add(current); err != nil {
+		return err
+	}
+
+	for _, prev := range config.PreviousMasterKeys {
+		if prev = strings.TrimSpace(prev); prev == "" {
+			continue
+		}
+		if _, err := k.add(prev); err != nil {
+			return err
+		}
+	}
+
+	credentialCipher = k
+	return nil
+}
+
+// add registers the master key and returns the ID the key is referenced by
+// in encrypted values
+func (k *keyring) add(masterKey string) (string, error) {
+	keyID, err := hkdf.Key(sha256.New, []byte(masterKey), nil, credentialIDInfo, 4)
+	if err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(keyID)
+	k.keys[id] = []byte(masterKey)
+	return id, nil
+}
+
+// aead derives the AES-256-GCM cipher for a value from the master key and
+// the salt of the value
+func (k *keyring) aead(keyID string, salt []byte) (cipher.AEAD, error) {
+	masterKey, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Value was encrypted with unknown master key %s", keyID)
+	}
+
+	key, err := hkdf.Key(sha256.New, masterKey, salt, credentialKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newCredentialAEAD(key)
+}
+
+func newCredentialAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals the plaintext with the current key. The context (for example
+// the account ID) is authenticated but not stored so a value can not be moved
+// to another context.
+func (k *keyring) Encrypt(plaintext, context string) (string, error) {
+	salt := make([]byte, credentialSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+
+	aead, err := k.aead(k.current, salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(append(salt, nonce...), nonce, []byte(plaintext), []byte(context))
+	return strings.Join([]string{encryptedValuePrefix, k.current, base64.StdEncoding.EncodeToString(sealed)}, ":"), nil
+}
+
+// Decrypt opens a value created by Encrypt with any known key
+func (k *keyring) Decrypt(value, context string) (string, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] != encryptedValuePrefix {
+		return "", fmt.Errorf("Invalid encrypted value")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < credentialSaltSize {
+		return "", fmt.Errorf("Invalid encrypted value")
+	}
+
+	aead, err := k.aead(parts[1], sealed[:credentialSaltSize])
+	if err != nil {
+		return "", err
+	}
+
+	sealed = sealed[credentialSaltSize:]
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("Invalid encrypted value")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(context))
+	if err != nil {
+		return "", fmt.Errorf("Unable to decrypt value: %s", err)
+	}
+
+	return string(plain), nil
+}
+
+// NeedsRotation reports whether the value was not encrypted with the current key
+func (k *keyring) NeedsRotation(value string) bool {
+	parts := strings.SplitN(value, ":", 3)
+	return len(parts) != 3 || parts[1] != k.current
+}
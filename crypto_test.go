@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const (
+	testMasterKey   = "Wm0V6Pj3sZbqV5YtM1lHk8Q2xRr4aNc7"
+	testPreviousKey = "Zq8Lr2Xv5Nw1Ty7Bp4Hs9Kd3Mf6Gc0Ja"
+	testAccount     = "alice"
+)
+
+func withMasterKeys(t *testing.T, current string, previous ...string) *keyring {
+	t.Helper()
+
+	savedCipher := credentialCipher
+	t.Cleanup(func() { credentialCipher = savedCipher })
+
+	withConfig(t, func(c *configuration) {
+		c.MasterKey, c.MasterKeyFile, c.PreviousMasterKeys = current, "", previous
+	})
+	credentialCipher = nil
+	if err := loadCredentialCipher(); err != nil {
+		t.Fatalf("Unable to load master keys: %s", err)
+	}
+	return credentialCipher
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k := withMasterKeys(t, testMasterKey)
+
+	first, err := k.Encrypt("token", testAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := k.Encrypt("token", testAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(first, encryptedValuePrefix+":"+k.current+":") {
+		t.Errorf("Unexpected format of encrypted value %s", first)
+	}
+	if first == second {
+		t.Error("Encrypting the same token twice created the same value")
+	}
+
+	for _, value := range []string{first, second} {
+		plain, err := k.Decrypt(value, testAccount)
+		if err != nil || plain != "token" {
+			t.Errorf("Decrypt returned %q, %v", plain, err)
+		}
+		if k.NeedsRotation(value) {
+			t.Error("Value encrypted with the current key needs rotation")
+		}
+	}
+
+	if _, err := k.Decrypt(first, "bob"); err == nil {
+		t.Error("Value was decrypted in another context")
+	}
+
+	parts := strings.SplitN(first, ":", 3)
+	sealed, _ := base64.StdEncoding.DecodeString(parts[2])
+	sealed[0] ^= 1
+	if _, err := k.Decrypt(parts[0]+":"+parts[1]+":"+base64.StdEncoding.EncodeToString(sealed), testAccount); err == nil {
+		t.Error("Value with modified salt was decrypted")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old := withMasterKeys(t, testPreviousKey)
+	oldValue, err := old.Encrypt("token", testAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := withMasterKeys(t, testMasterKey, testPreviousKey)
+	plain, err := k.Decrypt(oldValue, testAccount)
+	if err != nil || plain != "token" {
+		t.Errorf("Decrypt of %s returned %q, %v", oldValue, plain, err)
+	}
+	if !k.NeedsRotation(oldValue) {
+		t.Errorf("Value %s does not need rotation", oldValue)
+	}
+
+	k = withMasterKeys(t, testMasterKey)
+	if _, err := k.Decrypt(oldValue, testAccount); err == nil || !strings.Contains(err.Error(), "unknown master key") {
+		t.Errorf("Expected unknown master key error, got %v", err)
+	}
+}
+
+func TestKeyringRejectsShortMasterKey(t *testing.T) {
+	savedCipher := credentialCipher
+	t.Cleanup(func() { credentialCipher = savedCipher })
+
+	withConfig(t, func(c *configuration) {
+		c.MasterKey, c.MasterKeyFile = "short passphrase", ""
+	})
+	if err := loadCredentialCipher(); err == nil || !strings.Contains(err.Error(), "at least") {
+		t.Errorf("Expected error for short master key, got %v", err)
+	}
+}
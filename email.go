@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+	"github.com/satori/go.uuid"
+)
+
+// Events of a task which can be sent as email
+const (
+	notifyCreated = "created" // Todo of an occurrence was created
+	notifyOverdue = "overdue" // Todo of an occurrence is overdue
+)
+
+// STARTTLS modes of the SMTP connection
+const (
+	starttlsAuto    = "auto"    // Use STARTTLS if the server offers it
+	starttlsRequire = "require" // Fail if the server does not offer STARTTLS
+	starttlsOff     = "off"     // Never use STARTTLS
+)
+
+const (
+	smtpTimeout         = 10 * time.Second
+	emailRetryInterval  = time.Minute
+	emailMaxPending     = 100
+	defaultEmailSubject = `{{ if .Digest }}{{ len .Notifications }} habitscheduler notifications{{ else }}{{ with index .Notifications 0 }}{{ if eq .Kind "overdue" }}Overdue{{ else }}Due{{ end }}: {{ .Task.Title }}{{ end }}{{ end }}`
+	defaultEmailBody    = `{{ range .Notifications -}}
+{{ if eq .Kind "overdue" -}}
+"{{ .Task.Title }}" is due since {{ .Due.Format "Mon, 02 Jan 2006 15:04 MST" }} and still open.
+{{- else -}}
+"{{ .Task.Title }}" is due, it was added to your todos in HabitRPG.
+{{- end }}
+{{ end }}`
+)
+
+// emailNotification is passed to the templates as part of the Notifications
+type emailNotification struct {
+	Kind    string
+	Time    time.Time
+	Account string
+	Task    HabitTask
+	Todo    *habitrpg.Task
+	Due     time.Time // Scheduled time of the occurrence
+}
+
+// emailMailer sends the notifications of the tasks right away or, with
+// --email-digest, bundled per recipient. Notifications which could not be
+// sent are kept in memory and sent again later.
+type emailMailer struct {
+	subject *template.Template
+	body    *template.Template
+	kick    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	lock    sync.Mutex
+	pending map[string][]emailNotification
+}
+
+// mailer is nil if no --smtp-host is configured
+var mailer *emailMailer
+
+func newEmailMailer() (*emailMailer, error) {
+	if config.SMTPHost == "" {
+		return nil, nil
+	}
+
+	switch config.SMTPStartTLS {
+	case starttlsAuto, starttlsRequire, starttlsOff:
+	default:
+		return nil, fmt.Errorf("Unknown STARTTLS mode %q, use %s, %s or %s", config.SMTPStartTLS, starttlsAuto, starttlsRequire, starttlsOff)
+	}
+
+	if _, err := mail.ParseAddress(config.SMTPFrom); err != nil {
+		return nil, fmt.Errorf("Invalid sender address %q: %s", config.SMTPFrom, err)
+	}
+
+	subjectSource, bodySource := defaultEmailSubject, defaultEmailBody
+	if config.EmailSubjectTemplate != "" {
+		subjectSource = config.EmailSubjectTemplate
+	}
+	if config.EmailBodyTemplateFile != "" {
+		raw, err := ioutil.ReadFile(config.EmailBodyTemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read email body template: %s", err)
+		}
+		bodySource = string(raw)
+	}
+
+	subject, err := template.New("subject").Parse(subjectSource)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse email subject template: %s", err)
+	}
+	body, err := template.New("body").Parse(bodySource)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse email body template: %s", err)
+	}
+
+	return &emailMailer{
+		subject: subject,
+		body:    body,
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: map[string][]emailNotification{},
+	}, nil
+}
+
+// validateNotifications checks the notification settings of a task
+func validateNotifications(emails, on []string) error {
+	for _, addr := range emails {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("Invalid email address %q in NotifyEmails: %s", addr, err)
+		}
+	}
+	for _, kind := range on {
+		if kind != notifyCreated && kind != notifyOverdue {
+			return fmt.Errorf("NotifyOn must only contain %s or %s", notifyCreated, notifyOverdue)
+		}
+	}
+	return nil
+}
+
+// handleEvent is subscribed to the event bus and queues a notification for
+// every recipient of the task if it asked for the event
+func (m *emailMailer) handleEvent(e Event) {
+	var kind string
+	switch e.Type {
+	case eventOccurrenceCreated:
+		kind = notifyCreated
+	case eventOccurrenceOverdue:
+		kind = notifyOverdue
+	default:
+		return
+	}
+
+	if e.Task == nil || !e.Task.notifies(kind) {
+		return
+	}
+
+	n := emailNotification{
+		Kind:    kind,
+		Time:    e.Time,
+		Account: e.Account,
+		Task:    *e.Task,
+		Todo:    e.Todo,
+		Due:     e.Task.NextEntryDate,
+	}
+
+	m.lock.Lock()
+	for _, to := range e.Task.NotifyEmails {
+		queued := append(m.pending[to], n)
+		if len(queued) > emailMaxPending {
+			log.Printf("Dropping %d email notifications for %s which could not be sent", len(queued)-emailMaxPending, to)
+			queued = queued[len(queued)-emailMaxPending:]
+		}
+		m.pending[to] = queued
+	}
+	m.lock.Unlock()
+
+	if config.EmailDigest == 0 {
+		select {
+		case m.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifies reports whether an email is sent for the kind of notification
+func (t HabitTask) notifies(kind string) bool {
+	if len(t.NotifyEmails) == 0 {
+		return false
+	}
+	for _, k := range t.NotifyOn {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// run sends the queued notifications whenever new ones are queued or, in
+// digest mode, every --email-digest. Failed notifications are retried on
+// the next run. On stop the queued notifications are sent a last time.
+func (m *emailMailer) run() {
+	defer close(m.done)
+
+	interval := emailRetryInterval
+	if config.EmailDigest > 0 {
+		interval = config.EmailDigest
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			m.flush()
+			return
+		case <-m.kick:
+		case <-ticker.C:
+		}
+
+		m.flush()
+	}
+}
+
+// Stop sends the queued notifications and ends the mailer
+func (m *emailMailer) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *emailMailer) flush() {
+	m.lock.Lock()
+	pending := m.pending
+	m.pending = map[string][]emailNotification{}
+	m.lock.Unlock()
+
+	for to, notifications := range pending {
+		batches := [][]emailNotification{notifications}
+		if config.EmailDigest == 0 {
+			batches = nil
+			for _, n := range notifications {
+				batches = append(batches, []emailNotification{n})
+			}
+		}
+
+		for i, batch := range batches {
+			if err := m.send(to, batch); err != nil {
+				log.Printf("Unable to send email to %s, retrying later: %s", to, err)
+				metricEmails.Inc("error")
+
+				m.lock.Lock()
+				var failed []emailNotification
+				for _, b := range batches[i:] {
+					failed = append(failed, b...)
+				}
+				m.pending[to] = append(failed, m.pending[to]...)
+				m.lock.Unlock()
+				break
+			}
+			metricEmails.Inc("sent")
+		}
+	}
+}
+
+// send renders the templates for the notifications and sends them to the
+// recipient as one email
+func (m *emailMailer) send(to string, notifications []emailNotification) error {
+	data := struct {
+		Digest        bool
+		Notifications []emailNotification
+	}{config.EmailDigest > 0, notifications}
+
+	subject := new(bytes.Buffer)
+	if err := m.subject.Execute(subject, data); err != nil {
+		return fmt.Errorf("Unable to render subject: %s", err)
+	}
+	body := new(bytes.Buffer)
+	if err := m.body.Execute(body, data); err != nil {
+		return fmt.Errorf("Unable to render body: %s", err)
+	}
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\n", config.SMTPFrom)
+	fmt.Fprintf(msg, "To: %s\r\n", to)
+	// Long subjects are split into several encoded words, fold the header
+	// between them to keep the lines short
+	encodedSubject := mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String()))
+	fmt.Fprintf(msg, "Subject: %s\r\n", strings.Replace(encodedSubject, "?= =?", "?=\r\n =?", -1))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Message-ID: <%s@habitscheduler>\r\n", uuid.NewV4().String())
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(msg)
+	qp.Write(bytes.Replace(body.Bytes(), []byte("\n"), []byte("\r\n"), -1))
+	qp.Close()
+
+	return sendMail(to, msg.Bytes())
+}
+
+// sendMail delivers the message through --smtp-host, using STARTTLS
+// according to --smtp-starttls and authenticating if a user is set
+func sendMail(to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(config.SMTPHost)
+	if err != nil {
+		return fmt.Errorf("Invalid SMTP host %q: %s", config.SMTPHost, err)
+	}
+
+	conn, err := net.DialTimeout("tcp", config.SMTPHost, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(3 * smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if config.SMTPStartTLS != starttlsOff {
+		ok, _ := c.Extension("STARTTLS")
+		switch {
+		case ok:
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return fmt.Errorf("STARTTLS failed: %s", err)
+			}
+		case config.SMTPStartTLS == starttlsRequire:
+			return fmt.Errorf("SMTP server does not offer STARTTLS")
+		}
+	}
+
+	if config.SMTPUsername != "" {
+		// PlainAuth refuses to send the password without TLS unless the
+		// server is on localhost
+		if err := c.Auth(smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %s", err)
+		}
+	}
+
+	from, _ := mail.ParseAddress(config.SMTPFrom)
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(rcpt.Address); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpFake is a minimal SMTP server recording the commands and messages it
+// receives. It never completes a TLS handshake, STARTTLS is refused.
+type smtpFake struct {
+	ln       net.Listener
+	startTLS bool // Advertise STARTTLS in the EHLO response
+
+	// failData decides whether the n-th (0 based) message is rejected,
+	// onData is called for every message before answering it
+	failData func(n int) bool
+	onData   func(n int)
+
+	lock     sync.Mutex
+	commands []string
+	auth     []string
+	messages []smtpMessage
+}
+
+type smtpMessage struct {
+	from, to string
+	data     string
+}
+
+func newSMTPFake(t *testing.T, startTLS bool) *smtpFake {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &smtpFake{ln: ln, startTLS: startTLS}
+	go f.serve()
+
+	t.Cleanup(func() { ln.Close() })
+
+	withConfig(t, func(c *configuration) {
+		c.SMTPHost = ln.Addr().String()
+		c.SMTPFrom = "Habits <habits@example.com>"
+		c.SMTPStartTLS = starttlsAuto
+		c.SMTPUsername = ""
+		c.SMTPPassword = ""
+		c.EmailDigest = 0
+		c.EmailSubjectTemplate = ""
+		c.EmailBodyTemplateFile = ""
+	})
+
+	return f
+}
+
+func (f *smtpFake) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *smtpFake) handle(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+
+	c.PrintfLine("220 fake ESMTP")
+	var from, to string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		f.lock.Lock()
+		f.commands = append(f.commands, verb)
+		f.lock.Unlock()
+
+		switch verb {
+		case "EHLO":
+			c.PrintfLine("250-fake")
+			if f.startTLS {
+				c.PrintfLine("250-STARTTLS")
+			}
+			c.PrintfLine("250 AUTH PLAIN")
+
+		case "STARTTLS":
+			c.PrintfLine("454 TLS not available")
+
+		case "AUTH":
+			parts := strings.Fields(line)
+			creds, _ := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+			f.lock.Lock()
+			f.auth = append(f.auth, string(creds))
+			f.lock.Unlock()
+			c.PrintfLine("235 Authenticated")
+
+		case "MAIL":
+			from = line
+			c.PrintfLine("250 OK")
+
+		case "RCPT":
+			to = line
+			c.PrintfLine("250 OK")
+
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := ioutil.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+
+			f.lock.Lock()
+			n := len(f.messages)
+			f.lock.Unlock()
+
+			if f.onData != nil {
+				f.onData(n)
+			}
+			if f.failData != nil && f.failData(n) {
+				f.lock.Lock()
+				f.messages = append(f.messages, smtpMessage{})
+				f.lock.Unlock()
+				c.PrintfLine("451 Try again later")
+				continue
+			}
+
+			f.lock.Lock()
+			f.messages = append(f.messages, smtpMessage{from, to, string(data)})
+			f.lock.Unlock()
+			c.PrintfLine("250 Queued")
+
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (f *smtpFake) sent() []smtpMessage {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var out []smtpMessage
+	for _, m := range f.messages {
+		if m.data != "" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func (f *smtpFake) received(verb string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, c := range f.commands {
+		if c == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSentMessage decodes the subject and the quoted-printable body
+func parseSentMessage(t *testing.T, raw string) (subject, body string) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Unable to parse sent message: %s", err)
+	}
+
+	if cte := msg.Header.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding is %q", cte)
+	}
+
+	subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("Unable to decode subject: %s", err)
+	}
+
+	b, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("Unable to decode body: %s", err)
+	}
+	return subject, string(b)
+}
+
+func testNotificationEvent(eventType, title string, emails ...string) Event {
+	return newEvent(eventType, defaultAccountID, &HabitTask{
+		ID:            "task-" + title,
+		Title:         title,
+		NextEntryDate: time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC),
+		NotifyEmails:  emails,
+		NotifyOn:      []string{notifyCreated, notifyOverdue},
+	}, nil)
+}
+
+func newTestMailer(t *testing.T) *emailMailer {
+	m, err := newEmailMailer()
+	if err != nil {
+		t.Fatalf("Unable to create mailer: %s", err)
+	}
+	return m
+}
+
+func TestSendMailStartTLS(t *testing.T) {
+	t.Run("require without STARTTLS", func(t *testing.T) {
+		f := newSMTPFake(t, false)
+		withConfig(t, func(c *configuration) { c.SMTPStartTLS = starttlsRequire })
+
+		err := sendMail("alice@example.com", []byte("Subject: test\r\n\r\ntest\r\n"))
+		if err == nil || !strings.Contains(err.Error(), "does not offer STARTTLS") {
+			t.Fatalf("Expected STARTTLS to be required, got %v", err)
+		}
+		if f.received("MAIL") {
+			t.Error("Mail was sent without STARTTLS")
+		}
+	})
+
+	t.Run("off with STARTTLS offered", func(t *testing.T) {
+		f := newSMTPFake(t, true)
+		withConfig(t, func(c *configuration) { c.SMTPStartTLS = starttlsOff })
+
+		if err := sendMail("alice@example.com", []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+			t.Fatalf("Sending failed: %s", err)
+		}
+		if f.received("STARTTLS") {
+			t.Error("STARTTLS was used although it is off")
+		}
+		if len(f.sent()) != 1 {
+			t.Errorf("Expected 1 message, got %d", len(f.sent()))
+		}
+	})
+
+	t.Run("auto without STARTTLS", func(t *testing.T) {
+		f := newSMTPFake(t, false)
+
+		if err := sendMail("alice@example.com", []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+			t.Fatalf("Sending failed: %s", err)
+		}
+		if len(f.sent()) != 1 {
+			t.Errorf("Expected 1 message, got %d", len(f.sent()))
+		}
+	})
+}
+
+func TestSendMailAuth(t *testing.T) {
+	f := newSMTPFake(t, false)
+	withConfig(t, func(c *configuration) {
+		c.SMTPUsername = "habits"
+		c.SMTPPassword = "s3cret"
+	})
+
+	if err := sendMail("Alice <alice@example.com>", []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+		t.Fatalf("Sending failed: %s", err)
+	}
+
+	f.lock.Lock()
+	auth := f.auth
+	f.lock.Unlock()
+	if len(auth) != 1 || auth[0] != "\x00habits\x00s3cret" {
+		t.Errorf("Unexpected AUTH PLAIN credentials %q", auth)
+	}
+
+	sent := f.sent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(sent))
+	}
+	if sent[0].from != "MAIL FROM:<habits@example.com>" || sent[0].to != "RCPT TO:<alice@example.com>" {
+		t.Errorf("Unexpected envelope %q / %q", sent[0].from, sent[0].to)
+	}
+}
+
+func TestMailerEncoding(t *testing.T) {
+	f := newSMTPFake(t, false)
+	m := newTestMailer(t)
+
+	title := "Füße gießen und " + strings.Repeat("Blumenerde nachfüllen ", 5) + "!"
+	m.handleEvent(testNotificationEvent(eventOccurrenceCreated, title, "alice@example.com"))
+	m.flush()
+
+	sent := f.sent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(sent))
+	}
+
+	// The DotReader of the fake turns CRLF into LF. Header lines must not
+	// exceed 998 characters, quoted-printable body lines 76.
+	limit := 998
+	for _, line := range strings.Split(sent[0].data, "\n") {
+		if line == "" {
+			limit = 76
+		}
+		if len(line) > limit {
+			t.Errorf("Line exceeds %d characters: %q", limit, line)
+		}
+		for _, r := range line {
+			if r > 127 {
+				t.Fatalf("Message contains non-ASCII characters: %q", line)
+			}
+		}
+	}
+	if !strings.Contains(sent[0].data, "?=\n =?utf-8?q?") {
+		t.Errorf("Long subject was not folded: %q", sent[0].data)
+	}
+
+	subject, body := parseSentMessage(t, sent[0].data)
+	if subject != "Due: "+title {
+		t.Errorf("Unexpected subject %q", subject)
+	}
+	if !strings.Contains(body, `"`+title+`" is due, it was added to your todos in HabitRPG.`) {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestMailerDigest(t *testing.T) {
+	f := newSMTPFake(t, false)
+	withConfig(t, func(c *configuration) { c.EmailDigest = time.Hour })
+	m := newTestMailer(t)
+
+	m.handleEvent(testNotificationEvent(eventOccurrenceCreated, "Reload FitBit", "alice@example.com", "bob@example.com"))
+	m.handleEvent(testNotificationEvent(eventOccurrenceOverdue, "Water plants", "alice@example.com"))
+	m.handleEvent(testNotificationEvent(eventTaskTriggered, "Ignored", "alice@example.com"))
+	m.flush()
+
+	counts := map[string]int{}
+	for _, msg := range f.sent() {
+		subject, body := parseSentMessage(t, msg.data)
+		switch msg.to {
+		case "RCPT TO:<alice@example.com>":
+			if subject != "2 habitscheduler notifications" {
+				t.Errorf("Unexpected digest subject %q", subject)
+			}
+			if !strings.Contains(body, `"Reload FitBit" is due`) || !strings.Contains(body, `"Water plants" is due since Mon, 19 Oct 2026 08:00 UTC`) {
+				t.Errorf("Digest for alice misses notifications: %q", body)
+			}
+		case "RCPT TO:<bob@example.com>":
+			if subject != "1 habitscheduler notifications" {
+				t.Errorf("Unexpected digest subject %q", subject)
+			}
+		}
+		counts[msg.to]++
+	}
+
+	if counts["RCPT TO:<alice@example.com>"] != 1 || counts["RCPT TO:<bob@example.com>"] != 1 || len(counts) != 2 {
+		t.Errorf("Expected one digest per recipient, got %v", counts)
+	}
+}
+
+func TestMailerRequeuesFailedBatches(t *testing.T) {
+	f := newSMTPFake(t, false)
+	m := newTestMailer(t)
+
+	f.failData = func(n int) bool { return n == 1 }
+	f.onData = func(n int) {
+		if n == 1 {
+			// Queued while the failing send is in progress
+			m.handleEvent(testNotificationEvent(eventOccurrenceCreated, "Late", "alice@example.com"))
+		}
+	}
+
+	for _, title := range []string{"First", "Second", "Third"} {
+		m.handleEvent(testNotificationEvent(eventOccurrenceCreated, title, "alice@example.com"))
+	}
+	m.flush()
+
+	if sent := f.sent(); len(sent) != 1 {
+		t.Fatalf("Expected only the first message to be sent, got %d", len(sent))
+	}
+
+	var titles []string
+	for _, n := range m.pending["alice@example.com"] {
+		titles = append(titles, n.Task.Title)
+	}
+	if got := strings.Join(titles, ","); got != "Second,Third,Late" {
+		t.Errorf("Unexpected pending notifications after failure: %s", got)
+	}
+
+	// The retry sends the remaining notifications in order
+	f.failData = nil
+	f.onData = nil
+	m.flush()
+
+	titles = nil
+	for _, msg := range f.sent() {
+		subject, _ := parseSentMessage(t, msg.data)
+		titles = append(titles, strings.TrimPrefix(subject, "Due: "))
+	}
+	if got := strings.Join(titles, ","); got != "First,Second,Third,Late" {
+		t.Errorf("Unexpected order of sent notifications: %s", got)
+	}
+	if len(m.pending) != 0 {
+		t.Errorf("Notifications still pending after retry: %v", m.pending)
+	}
+}
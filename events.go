@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+	"github.com/satori/go.uuid"
+)
+
+// Types of the events published about the tasks and their occurrences
+const (
+	eventTaskCreated         = "task.created"
+	eventTaskUpdated         = "task.updated"
+	eventTaskDeleted         = "task.deleted"
+	eventTaskTriggered       = "task.triggered"
+	eventOccurrenceCreated   = "occurrence.created"   // Todo was created in HabitRPG
+	eventOccurrenceCompleted = "occurrence.completed" // Todo was completed in HabitRPG
+	eventOccurrenceDeleted   = "occurrence.deleted"   // Todo was deleted in HabitRPG
+	eventOccurrenceOverdue   = "occurrence.overdue"   // Todo is open longer than the overdue threshold
+	eventSyncFailed          = "sync.failed"          // Communication with HabitRPG failed
+)
+
+var eventTypes = []string{
+	eventTaskCreated, eventTaskUpdated, eventTaskDeleted, eventTaskTriggered,
+	eventOccurrenceCreated, eventOccurrenceCompleted, eventOccurrenceDeleted, eventOccurrenceOverdue,
+	eventSyncFailed,
+}
+
+// Event describes something which happened to a task, Task is the state of
+// the task after the event and Todo the todo in HabitRPG if it is involved
+type Event struct {
+	ID      string         `json:"id"`
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Account string         `json:"account"`
+	Task    *HabitTask     `json:"task,omitempty"`
+	Todo    *habitrpg.Task `json:"todo,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// eventBus passes the published events to all subscribers. Subscribers are
+// called synchronously in the order they subscribed and must not block.
+type eventBus struct {
+	lock        sync.RWMutex
+	subscribers []func(Event)
+}
+
+var events = &eventBus{}
+
+// Subscribe registers fn to be called for every event published afterwards
+func (b *eventBus) Subscribe(fn func(Event)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.subscribers = append(b.subscribers, fn)
+}
+
+func (b *eventBus) publish(e Event) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, fn := range b.subscribers {
+		fn(e)
+	}
+}
+
+// newEvent creates an event of the account, task and todo are copied so the
+// event keeps their state at the time it happened
+func newEvent(eventType, account string, task *HabitTask, todo *habitrpg.Task) Event {
+	e := Event{
+		ID:      uuid.NewV4().String(),
+		Type:    eventType,
+		Time:    time.Now(),
+		Account: account,
+	}
+	if task != nil {
+		t := *task
+		e.Task = &t
+	}
+	if todo != nil {
+		t := *todo
+		e.Todo = &t
+	}
+	return e
+}
+
+// publishEvent publishes an event about the task to all subscribers. The
+// store must not be locked by the caller, events created while it is locked
+// are collected and published afterwards.
+func publishEvent(e Event) {
+	metricEvents.Inc(e.Type)
+	events.publish(e)
+}
+
+// eventMatches checks the type against a filter of event types, a filter
+// ending in .* matches all types with that prefix and an empty filter
+// matches all types
+func eventMatches(filter []string, eventType string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == eventType || (strings.HasSuffix(f, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(f, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// validEventFilter checks all entries of a filter match at least one type
+func validEventFilter(filter []string) bool {
+	for _, f := range filter {
+		matched := false
+		for _, t := range eventTypes {
+			matched = matched || eventMatches([]string{f}, t)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// checkOverdue publishes an overdue event once per occurrence whose todo is
+// open for longer than the OverdueHours of its task or --overdue-after
+func (h *HabitTaskStore) checkOverdue() {
+	overdue := []Event{}
+
+	h.lock.Lock()
+	for i := range h.Tasks {
+		task := &h.Tasks[i]
+		threshold := task.overdueAfter()
+		if task.IsCompleted || task.IsPaused || task.OverdueReported || threshold <= 0 || time.Since(task.NextEntryDate) < threshold {
+			continue
+		}
+
+		task.OverdueReported = true
+		overdue = append(overdue, newEvent(eventOccurrenceOverdue, h.accountID, task, nil))
+	}
+	h.lock.Unlock()
+
+	if len(overdue) == 0 {
+		return
+	}
+
+	h.markChanged()
+	for _, e := range overdue {
+		publishEvent(e)
+	}
+}
+
+// overdueAfter returns how long the todo of an occurrence may be open before
+// it is overdue, 0 if the task is never overdue
+func (t HabitTask) overdueAfter() time.Duration {
+	if t.OverdueHours > 0 {
+		return time.Duration(t.OverdueHours) * time.Hour
+	}
+	return config.OverdueAfter
+}
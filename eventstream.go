@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamKeepalive      = 30 * time.Second
+	streamSubscriberSize = 64
+)
+
+// streamEvent is an event numbered in the order it was published
+type streamEvent struct {
+	Seq uint64
+	Event
+}
+
+// eventStream keeps the last --event-buffer-size events for clients
+// resuming a stream and passes new events to the connected clients. Event
+// IDs are prefixed with an epoch identifying the process so IDs handed out
+// before a restart are not mistaken for current ones.
+type eventStream struct {
+	epoch string
+
+	lock        sync.Mutex
+	seq         uint64
+	buffer      []streamEvent
+	subscribers map[chan streamEvent]struct{}
+}
+
+var stream = &eventStream{
+	epoch:       strconv.FormatInt(startedAt.UnixNano(), 36),
+	subscribers: map[chan streamEvent]struct{}{},
+}
+
+// handleEvent is subscribed to the event bus. Clients not keeping up are
+// disconnected, they resume from the buffer when they reconnect.
+func (s *eventStream) handleEvent(e Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq++
+	se := streamEvent{Seq: s.seq, Event: e}
+
+	s.buffer = append(s.buffer, se)
+	if over := len(s.buffer) - config.EventBufferSize; over > 0 {
+		s.buffer = append([]streamEvent{}, s.buffer[over:]...)
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- se:
+		default:
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a client and returns the buffered events after the
+// given event ID. If events after lastID were dropped from the buffer
+// already or lastID is unknown nothing is replayed and the ID of the latest
+// event is returned as resetID instead.
+func (s *eventStream) subscribe(lastID string) (ch chan streamEvent, replay []streamEvent, resetID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ch = make(chan streamEvent, streamSubscriberSize)
+	s.subscribers[ch] = struct{}{}
+
+	if lastID == "" {
+		return ch, nil, ""
+	}
+
+	oldest := s.seq + 1
+	if len(s.buffer) > 0 {
+		oldest = s.buffer[0].Seq
+	}
+
+	seq, ok := s.parseID(lastID)
+	if !ok || seq > s.seq || seq+1 < oldest {
+		return ch, nil, s.id(s.seq)
+	}
+
+	for _, se := range s.buffer {
+		if se.Seq > seq {
+			replay = append(replay, se)
+		}
+	}
+	return ch, replay, ""
+}
+
+func (s *eventStream) unsubscribe(ch chan streamEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.subscribers[ch]; ok {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// closeAll disconnects all clients, used on shutdown as the server waits
+// for the streams to end otherwise
+func (s *eventStream) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for ch := range s.subscribers {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (s *eventStream) id(seq uint64) string {
+	return fmt.Sprintf("%s-%d", s.epoch, seq)
+}
+
+func (s *eventStream) parseID(id string) (uint64, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != s.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	return seq, err == nil
+}
+
+// handleEventStream streams the events of the account as Server-Sent Events,
+// optionally filtered by the comma separated event types in the types
+// parameter. A client sending Last-Event-ID gets the buffered events it
+// missed first, if they are not buffered anymore a "reset" event tells it to
+// reload its state instead.
+func handleEventStream(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		http.Error(res, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var types []string
+	if t := r.URL.Query().Get("types"); t != "" {
+		types = strings.Split(t, ",")
+		if !validEventFilter(types) {
+			http.Error(res, fmt.Sprintf("Unknown event type, available are: %s", strings.Join(eventTypes, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		// EventSource can not set headers on the first connection
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	ch, replay, resetID := stream.subscribe(lastID)
+	defer stream.unsubscribe(ch)
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	send := func(se streamEvent) {
+		if se.Account != store.accountID || !eventMatches(types, se.Type) {
+			return
+		}
+		data, _ := json.Marshal(se.Event)
+		fmt.Fprintf(res, "id: %s\nevent: %s\ndata: %s\n\n", stream.id(se.Seq), se.Type, data)
+	}
+
+	if resetID != "" {
+		fmt.Fprintf(res, "id: %s\nevent: reset\ndata: {}\n\n", resetID)
+	}
+	for _, se := range replay {
+		send(se)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(res, ": keepalive\n\n")
+		case se, ok := <-ch:
+			if !ok {
+				return
+			}
+			send(se)
+		}
+		flusher.Flush()
+	}
+}
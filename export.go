@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/satori/go.uuid"
+)
+
+// exportFormatVersion is written by Export, version 1 contained the tasks
+// only and is still accepted by Import
+const exportFormatVersion = 2
+
+const (
+	importModeMerge   = "merge"
+	importModeReplace = "replace"
+
+	importConflictSkip      = "skip"
+	importConflictOverwrite = "overwrite"
+	importConflictNewID     = "new-id"
+)
+
+// StoreExport is the versioned document written by Export and read by Import
+type StoreExport struct {
+	Version       int                `json:"version"`
+	SchemaVersion int                `json:"schema_version"`
+	ExportedAt    time.Time          `json:"exported_at"`
+	Settings      *AccountSettings   `json:"settings,omitempty"`
+	Tasks         []HabitTask        `json:"tasks"`
+	History       []OccurrenceRecord `json:"history"`
+}
+
+// AccountSettings are the settings of the exported account. The API token is
+// never exported so the HabitRPG user is only informational.
+type AccountSettings struct {
+	Name           string `json:"name"`
+	HabitRPGUserID string `json:"habitrpg_user_id"`
+}
+
+// ImportResult describes what happened to the tasks contained in an import
+type ImportResult struct {
+	Mode       string            `json:"mode"`
+	Created    []string          `json:"created"`
+	Replaced   []string          `json:"replaced"`
+	Skipped    []string          `json:"skipped"`
+	Reassigned map[string]string `json:"reassigned"`
+	History    int               `json:"history"`
+
+	// Settings contained in the import, they are only applied in replace mode
+	Settings *AccountSettings `json:"settings,omitempty"`
+}
+
+// Export returns a snapshot of all tasks in the store
+func (h *HabitTaskStore) Export() StoreExport {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	tasks := make([]HabitTask, len(h.Tasks))
+	copy(tasks, h.Tasks)
+	history := make([]OccurrenceRecord, len(h.History))
+	copy(history, h.History)
+
+	return StoreExport{
+		Version:       exportFormatVersion,
+		SchemaVersion: currentSchemaVersion,
+		ExportedAt:    time.Now(),
+		Tasks:         tasks,
+		History:       history,
+	}
+}
+
+// Import reads an export document and applies it to the store. In merge mode
+// existing tasks are kept and tasks having the ID of an existing task are
+// handled according to onConflict, the history of the imported tasks is added
+// to the existing one. In replace mode all existing tasks and the history are
+// dropped before the import.
+func (h *HabitTaskStore) Import(data []byte, mode, onConflict string) (*ImportResult, error) {
+	raw := struct {
+		Version       int                `json:"version"`
+		SchemaVersion int                `json:"schema_version"`
+		Settings      *AccountSettings   `json:"settings"`
+		Tasks         json.RawMessage    `json:"tasks"`
+		History       []OccurrenceRecord `json:"history"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Could not deserialize JSON: %s", err)
+	}
+
+	if raw.Version < 1 || raw.Version > exportFormatVersion {
+		return nil, fmt.Errorf("Unsupported export version %d", raw.Version)
+	}
+
+	// Tasks inside the export use the store schema of the exporting build so
+	// they need the same upgrades as a document loaded from Redis
+	storeDoc, err := json.Marshal(map[string]interface{}{
+		schemaVersionKey: raw.SchemaVersion,
+		"Tasks":          raw.Tasks,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if storeDoc, err = migrateStoreDocument(storeDoc); err != nil {
+		return nil, fmt.Errorf("Unable to upgrade exported tasks: %s", err)
+	}
+
+	doc := struct{ Tasks []HabitTask }{}
+	if err := json.Unmarshal(storeDoc, &doc); err != nil {
+		return nil, fmt.Errorf("Could not deserialize tasks: %s", err)
+	}
+
+	switch mode {
+	case importModeMerge, importModeReplace:
+	default:
+		return nil, fmt.Errorf("Unknown import mode %q", mode)
+	}
+
+	switch onConflict {
+	case importConflictSkip, importConflictOverwrite, importConflictNewID:
+	default:
+		return nil, fmt.Errorf("Unknown conflict handling %q", onConflict)
+	}
+
+	// Creations queued by the exporting instance are not part of the export,
+	// the todos are adopted by their alias when the tasks are created again
+	for i := range doc.Tasks {
+		doc.Tasks[i].PendingCreate = ""
+	}
+
+	seen := map[string]bool{}
+	for _, t := range doc.Tasks {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("Task %q is invalid: %s", t.ID, err)
+		}
+		if seen[t.ID] {
+			return nil, fmt.Errorf("Task ID %q is contained more than once", t.ID)
+		}
+		seen[t.ID] = true
+	}
+
+	res := &ImportResult{
+		Mode:       mode,
+		Created:    []string{},
+		Replaced:   []string{},
+		Skipped:    []string{},
+		Reassigned: map[string]string{},
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if mode == importModeReplace {
+		h.Tasks = []HabitTask{}
+		h.History = nil
+		res.Settings = raw.Settings
+	}
+
+	existing := map[string]int{}
+	for i, t := range h.Tasks {
+		existing[t.ID] = i
+	}
+
+	for _, t := range doc.Tasks {
+		idx, ok := existing[t.ID]
+		if !ok {
+			h.Tasks = append(h.Tasks, t)
+			res.Created = append(res.Created, t.ID)
+			continue
+		}
+
+		switch onConflict {
+		case importConflictSkip:
+			res.Skipped = append(res.Skipped, t.ID)
+		case importConflictOverwrite:
+			h.Tasks[idx] = t
+			res.Replaced = append(res.Replaced, t.ID)
+		case importConflictNewID:
+			oldID := t.ID
+			t.ID = uuid.NewV4().String()
+			h.Tasks = append(h.Tasks, t)
+			res.Created = append(res.Created, t.ID)
+			res.Reassigned[oldID] = t.ID
+		}
+	}
+
+	// Only the history of tasks taken from the import is added, records
+	// already known from importing the same export before are skipped
+	imported := map[string]string{}
+	for _, id := range append(res.Created, res.Replaced...) {
+		imported[id] = id
+	}
+	for oldID, newID := range res.Reassigned {
+		imported[oldID] = newID
+		delete(imported, newID)
+	}
+	known := map[OccurrenceRecord]bool{}
+	for _, r := range h.History {
+		known[r.key()] = true
+	}
+	for _, r := range raw.History {
+		id, ok := imported[r.TaskID]
+		if !ok {
+			continue
+		}
+		r.TaskID = id
+		if known[r.key()] {
+			continue
+		}
+		known[r.key()] = true
+		h.History = append(h.History, r)
+		res.History++
+	}
+	sort.SliceStable(h.History, func(i, j int) bool { return h.History[i].Time.Before(h.History[j].Time) })
+	if len(h.History) > historySize {
+		h.History = h.History[len(h.History)-historySize:]
+	}
+
+	return res, nil
+}
+
+// key returns the record with times comparable using ==
+func (r OccurrenceRecord) key() OccurrenceRecord {
+	r.Due, r.Time = r.Due.UTC().Round(0), r.Time.UTC().Round(0)
+	return r
+}
+
+func (t HabitTask) validate() error {
+	if t.ID == "" {
+		return fmt.Errorf("Task has no ID")
+	}
+
+	if t.RepeatCron {
+		if _, err := cron.Parse(t.RepeatCronEntry); err != nil {
+			return fmt.Errorf("Could not parse cron format: %s", err)
+		}
+	}
+
+	if t.RepeatHours == 0 && !t.RepeatCron {
+		return fmt.Errorf("You must specify at least one of RepeatHours or RepeatCronEntry")
+	}
+
+	if !validOnDelete(t.OnDelete) {
+		return fmt.Errorf("Unknown OnDelete policy %q", t.OnDelete)
+	}
+
+	return validateNotifications(t.NotifyEmails, t.NotifyOn)
+}
+
+// publishImportEvents publishes the changes made by an import by comparing
+// the tasks of the store to the tasks before the import
+func publishImportEvents(store *HabitTaskStore, before []HabitTask) {
+	previous := map[string]HabitTask{}
+	for _, t := range before {
+		previous[t.ID] = t
+	}
+
+	for _, t := range store.Export().Tasks {
+		t := t
+		old, existed := previous[t.ID]
+		delete(previous, t.ID)
+
+		switch {
+		case !existed:
+			publishEvent(newEvent(eventTaskCreated, store.accountID, &t, nil))
+		case !sameTask(old, t):
+			publishEvent(newEvent(eventTaskUpdated, store.accountID, &t, nil))
+		}
+	}
+
+	for _, t := range before {
+		if _, dropped := previous[t.ID]; dropped {
+			t := t
+			publishEvent(newEvent(eventTaskDeleted, store.accountID, &t, nil))
+		}
+	}
+}
+
+// sameTask compares the stored representation of the tasks, times loaded
+// from an export differ from the ones in memory in their monotonic clock
+func sameTask(a, b HabitTask) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
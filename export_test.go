@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExportImportHistory(t *testing.T) {
+	due := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+
+	source := &HabitTaskStore{Tasks: []HabitTask{dueTestTask("a", "Water plants"), dueTestTask("b", "Feed cat")}}
+	for i, id := range []string{"a", "b", "a"} {
+		task := source.task(id)
+		task.LastTaskID, task.NextEntryDate = "todo", due.Add(time.Duration(i)*time.Hour)
+		source.addHistory(task, outcomeCompleted, due.Add(time.Duration(i)*time.Hour+time.Minute))
+	}
+
+	export := source.Export()
+	export.Settings = &AccountSettings{Name: "Alice", HabitRPGUserID: "user"}
+	data, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Task b exists, its history is skipped with the task
+	target := &HabitTaskStore{Tasks: []HabitTask{dueTestTask("b", "Feed dog")}}
+	res, err := target.Import(data, importModeMerge, importConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.History != 2 || len(target.History) != 2 || res.Settings != nil {
+		t.Fatalf("Unexpected merge result %+v, history %+v", res, target.History)
+	}
+	for _, r := range target.History {
+		if r.TaskID != "a" || r.TodoID != "todo" || r.Outcome != outcomeCompleted {
+			t.Errorf("Unexpected history record %+v", r)
+		}
+	}
+
+	// Importing the same export again does not duplicate the history
+	if res, err = target.Import(data, importModeMerge, importConflictOverwrite); err != nil {
+		t.Fatal(err)
+	}
+	if res.History != 1 || len(target.History) != 3 {
+		t.Errorf("Expected only the history of task b to be added, got %d, history %+v", res.History, target.History)
+	}
+	for i := 1; i < len(target.History); i++ {
+		if target.History[i].Time.Before(target.History[i-1].Time) {
+			t.Errorf("History is not ordered: %+v", target.History)
+		}
+	}
+
+	// New IDs are applied to the history as well
+	target = &HabitTaskStore{Tasks: []HabitTask{dueTestTask("a", "Water plants")}}
+	if res, err = target.Import(data, importModeMerge, importConflictNewID); err != nil {
+		t.Fatal(err)
+	}
+	newID := res.Reassigned["a"]
+	for _, r := range target.History {
+		if r.TaskID == "a" || (r.TaskID != newID && r.TaskID != "b") {
+			t.Errorf("History record %+v does not use the reassigned ID %s", r, newID)
+		}
+	}
+
+	target = &HabitTaskStore{History: []OccurrenceRecord{{TaskID: "old"}}}
+	if res, err = target.Import(data, importModeReplace, importConflictSkip); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.History) != 3 || res.Settings == nil || res.Settings.Name != "Alice" {
+		t.Errorf("Replace did not restore history and settings: %+v, history %+v", res, target.History)
+	}
+}
+
+func TestImportVersion1(t *testing.T) {
+	data := []byte(`{"version":1,"schema_version":2,"tasks":[{"ID":"a","Title":"Water plants","RepeatHours":24,"IsCompleted":true,"OnDelete":"skip"}]}`)
+
+	store := &HabitTaskStore{}
+	res, err := store.Import(data, importModeMerge, importConflictSkip)
+	if err != nil {
+		t.Fatalf("Export of version 1 was not accepted: %s", err)
+	}
+	if len(res.Created) != 1 || res.History != 0 || res.Settings != nil {
+		t.Errorf("Unexpected result %+v", res)
+	}
+
+	if _, err := store.Import([]byte(`{"version":3,"tasks":[]}`), importModeMerge, importConflictSkip); err == nil {
+		t.Error("Export of a newer version was accepted")
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"bytes"
@@ -14,38 +19,161 @@ import (
 
 	"github.com/robfig/cron"
 	"github.com/satori/go.uuid"
-	"github.com/xuyu/goredis"
 )
 
+// Policies for todos deleted in HabitRPG instead of being completed
+const (
+	onDeleteSkip     = "skip"     // Schedule the next occurrence as if it was completed now
+	onDeleteRecreate = "recreate" // Create the todo for the same occurrence again
+	onDeletePause    = "pause"    // Pause the task until it is resumed
+)
+
+// Outcomes of the last occurrence of a task
+const (
+	outcomeCompleted = "completed"
+	outcomeDeleted   = "deleted"
+)
+
+// historySize is the number of finished occurrences kept per account
+const historySize = 1000
+
+var errTodoNotFound = errors.New("Todo not found")
+
+// occurrenceAliasPrefix starts the aliases of all todos created by the
+// scheduler, Habitica does not accept aliases which are valid UUIDs
+const occurrenceAliasPrefix = "hs-"
+
 type HabitTaskStore struct {
-	Tasks []HabitTask `json:",omitempty"`
+	SchemaVersion int
+	Tasks         []HabitTask        `json:",omitempty"`
+	Outbox        []OutboxOperation  `json:",omitempty"`
+	History       []OccurrenceRecord `json:",omitempty"`
+
+	storage    storage
+	storeKey   string
+	accountID  string
+	client     *habitrpg.Client
+	clientLock sync.RWMutex
+	lock       sync.RWMutex
+
+	health     storeHealth
+	healthLock sync.RWMutex
+
+	// changes counts the modifications of the tasks, savedChanges is the
+	// count included in the last save. saved is closed after every save.
+	changes      uint64
+	savedChanges uint64
+	saved        chan struct{}
+	changeLock   sync.Mutex
+
+	// outboxLock makes sure every operation is only executed once at a time
+	outboxLock sync.Mutex
+}
 
-	redisConnection *goredis.Redis `json:"-"`
+// storeHealth tracks the outcome of the communication with HabitRPG
+type storeHealth struct {
+	LastUpdateSuccess   time.Time
+	LastUpdateError     string
+	CredentialsRejected bool
 }
 
-func NewHabitTaskStore(redisConnection *goredis.Redis) *HabitTaskStore {
+func NewHabitTaskStore(storage storage, account Account) *HabitTaskStore {
 	return &HabitTaskStore{
-		redisConnection: redisConnection,
-		Tasks:           []HabitTask{},
+		storage:       storage,
+		storeKey:      storeKeyForAccount(account.ID),
+		accountID:     account.ID,
+		client:        newHabitRPGClient(account.HabitRPGUserID, account.HabitRPGAPIToken),
+		SchemaVersion: currentSchemaVersion,
+		Tasks:         []HabitTask{},
+		saved:         make(chan struct{}),
 	}
 }
 
+// SetCredentials replaces the HabitRPG credentials used for this store
+func (h *HabitTaskStore) SetCredentials(userID, apiToken string) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+
+	h.client = newHabitRPGClient(userID, apiToken)
+}
+
+func newHabitRPGClient(userID, apiToken string) *habitrpg.Client {
+	c := habitrpg.NewClient(userID, apiToken)
+	c.Observer = observeHabiticaRequest
+	c.Breaker = habiticaBreaker
+	return c
+}
+
 func (h *HabitTaskStore) Save() error {
+	h.changeLock.Lock()
+	changes := h.changes
+	h.changeLock.Unlock()
+
+	h.lock.RLock()
 	data, err := json.Marshal(h)
+	h.lock.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	err = h.redisConnection.Set(config.RedisStoreKey, string(data), 0, 0, false, false)
+	err = h.storage.Set(h.storeKey, data)
 	if err != nil {
 		return err
 	}
 
+	h.changeLock.Lock()
+	if changes > h.savedChanges {
+		h.savedChanges = changes
+	}
+	close(h.saved)
+	h.saved = make(chan struct{})
+	h.changeLock.Unlock()
+
 	return nil
 }
 
+// markChanged records a modification of the tasks which has to be done
+// before calling it. The change is saved shortly after, the returned count
+// can be passed to waitSaved.
+func (h *HabitTaskStore) markChanged() uint64 {
+	h.changeLock.Lock()
+	h.changes++
+	changes := h.changes
+	h.changeLock.Unlock()
+
+	writer.notify()
+	return changes
+}
+
+// isDirty reports whether there are changes which were not saved yet
+func (h *HabitTaskStore) isDirty() bool {
+	h.changeLock.Lock()
+	defer h.changeLock.Unlock()
+
+	return h.changes > h.savedChanges
+}
+
+// waitSaved blocks until a save including the given change count succeeded
+func (h *HabitTaskStore) waitSaved(ctx context.Context, changes uint64) error {
+	for {
+		h.changeLock.Lock()
+		done, saved := h.savedChanges >= changes, h.saved
+		h.changeLock.Unlock()
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-saved:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func (h *HabitTaskStore) Load() error {
-	data, err := h.redisConnection.Get(config.RedisStoreKey)
+	data, err := h.storage.Get(h.storeKey)
 	if err != nil {
 		return err
 	}
@@ -54,106 +182,351 @@ func (h *HabitTaskStore) Load() error {
 		data = []byte("{}")
 	}
 
-	err = json.Unmarshal(data, h)
+	data, err = migrateStoreDocument(data)
 	if err != nil {
 		return err
 	}
 
+	// Decoded separately so fields missing in the document do not keep
+	// the values of a previous load
+	loaded := struct {
+		SchemaVersion int
+		Tasks         []HabitTask
+		Outbox        []OutboxOperation
+		History       []OccurrenceRecord
+	}{Tasks: []HabitTask{}}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.SchemaVersion, h.Tasks, h.Outbox, h.History = loaded.SchemaVersion, loaded.Tasks, loaded.Outbox, loaded.History
 	return nil
 }
 
 func (h *HabitTaskStore) doHTTPRequest(method, contentType, urlStr string, body io.Reader, targetVar interface{}) error {
-	req, err := http.NewRequest(method, fmt.Sprintf("https://habitrpg.com:443/api/v3%s", urlStr), body)
-	if err != nil {
-		return err
+	h.clientLock.RLock()
+	client := h.client
+	h.clientLock.RUnlock()
+
+	err := client.Do(method, contentType, urlStr, body, targetVar)
+
+	var statusErr habitrpg.StatusError
+	switch {
+	case err == nil:
+		h.setCredentialsRejected(false)
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized:
+		h.setCredentialsRejected(true)
 	}
-	req.Header.Add("x-api-key", config.HabitRPGAPIToken)
-	req.Header.Add("x-api-user", config.HabitRPGUserID)
-	req.Header.Add("Content-Type", contentType)
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
+	return err
+}
+
+func (h *HabitTaskStore) setCredentialsRejected(rejected bool) {
+	h.healthLock.Lock()
+	defer h.healthLock.Unlock()
+
+	h.health.CredentialsRejected = rejected
+}
+
+// Health returns the state of the communication with HabitRPG
+func (h *HabitTaskStore) Health() storeHealth {
+	h.healthLock.RLock()
+	defer h.healthLock.RUnlock()
+
+	return h.health
+}
 
-	if res.StatusCode >= 400 {
-		return fmt.Errorf("Unexpected status code received: %d", res.StatusCode)
+// hasCredentials reports whether HabitRPG credentials are configured for the
+// account, stores without credentials are skipped by the scheduling loops
+func (h *HabitTaskStore) hasCredentials() bool {
+	h.clientLock.RLock()
+	defer h.clientLock.RUnlock()
+
+	return h.client.UserID != "" && h.client.APIToken != ""
+}
+
+// UpdateStates fetches the todos of all open occurrences from HabitRPG and
+// updates the tasks whose todo was completed or deleted. Only todos are
+// listed and if few occurrences are open they are fetched one by one.
+func (h *HabitTaskStore) UpdateStates() (err error) {
+	start := time.Now()
+	skipped := false
+	defer func() {
+		result := "success"
+		switch {
+		case err == habitrpg.ErrCircuitOpen:
+			result = "circuit_open"
+		case err != nil:
+			result = "error"
+		case skipped:
+			result = "skipped"
+		}
+		metricUpdateStates.Inc(h.accountID, result)
+		metricUpdateStatesDuration.Observe(time.Since(start).Seconds(), h.accountID, result)
+
+		h.healthLock.Lock()
+		if err == nil {
+			h.health.LastUpdateSuccess = time.Now()
+			h.health.LastUpdateError = ""
+		} else {
+			h.health.LastUpdateError = err.Error()
+		}
+		h.healthLock.Unlock()
+
+		if err != nil && err != habitrpg.ErrCircuitOpen {
+			e := newEvent(eventSyncFailed, h.accountID, nil, nil)
+			e.Error = err.Error()
+			publishEvent(e)
+		}
+	}()
+
+	if !habiticaAvailable() {
+		return habitrpg.ErrCircuitOpen
 	}
 
-	if err := json.NewDecoder(res.Body).Decode(targetVar); err != nil {
-		return err
+	h.lock.RLock()
+	tracked := []string{}
+	for _, task := range h.Tasks {
+		if task.LastTaskID != "" {
+			tracked = append(tracked, task.LastTaskID)
+		}
 	}
+	h.lock.RUnlock()
 
-	return nil
-}
+	// Without open occurrences there is nothing to ask HabitRPG for
+	skipped = len(tracked) == 0
 
-func (h *HabitTaskStore) UpdateStates() error {
-	res := struct {
-		Data []habitrpg.Task `json:"data"`
-	}{}
+	todos := map[string]habitrpg.Task{}
+	missing := tracked
+
+	if len(tracked) > config.SyncFetchIndividually {
+		res := struct {
+			Data []habitrpg.Task `json:"data"`
+		}{}
+
+		if err := h.doHTTPRequest("GET", "application/json", "/tasks/user?type=todos", nil, &res); err != nil {
+			return fmt.Errorf("Unable to fetch current todos: %s", err)
+		}
+
+		for _, htask := range res.Data {
+			todos[htask.ID] = htask
+		}
+
+		// Completed todos are not part of the list, ask for the missing ones
+		// individually to tell completed from deleted todos
+		missing = []string{}
+		for _, id := range tracked {
+			if _, ok := todos[id]; !ok {
+				missing = append(missing, id)
+			}
+		}
+	}
 
-	if err := h.doHTTPRequest("GET", "application/json", "/tasks/user", nil, &res); err != nil {
-		return fmt.Errorf("Unable to fetch current tasks: %s", err)
+	deleted := map[string]bool{}
+	for _, id := range missing {
+		htask, ferr := h.fetchTodo(id)
+		switch {
+		case ferr == nil:
+			todos[id] = *htask
+		case ferr == errTodoNotFound:
+			deleted[id] = true
+		default:
+			// Leave the task untouched until its todo can be fetched
+			err = fmt.Errorf("Unable to fetch todo %s: %s", id, ferr)
+		}
 	}
 
+	changed := false
+	rescheduled := []string{}
+	occurred := []Event{}
+	defer func() {
+		if changed {
+			h.markChanged()
+		}
+		for _, e := range occurred {
+			publishEvent(e)
+		}
+	}()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
 	for i, _ := range h.Tasks {
 		task := &h.Tasks[i]
 		if task.LastTaskID == "" {
-			if !task.IsCompleted {
+			if !task.IsCompleted && task.PendingCreate == "" {
 				task.IsCompleted = true
+				changed = true
+				rescheduled = append(rescheduled, task.ID)
 			}
 			continue
 		}
 
-		taskFound := false
-		for _, htask := range res.Data {
-			if htask.ID == task.LastTaskID {
-				task.IsCompleted = htask.Completed
+		if htask, ok := todos[task.LastTaskID]; ok {
+			task.IsCompleted = htask.Completed
+			if task.IsCompleted {
+				changed = true
+				h.addHistory(task, outcomeCompleted, htask.DateCompleted)
 				task.updateNextEntryTime(htask.DateCompleted, false)
-				if task.IsCompleted {
-					task.LastTaskID = ""
-				}
-				taskFound = true
+				task.LastTaskID = ""
+				task.LastCompletedDate = htask.DateCompleted
+				task.LastOutcome = outcomeCompleted
+				rescheduled = append(rescheduled, task.ID)
+				occurred = append(occurred, newEvent(eventOccurrenceCompleted, h.accountID, task, &htask))
 			}
+			continue
 		}
-		if !taskFound {
-			task.IsCompleted = true
-			task.updateNextEntryTime(time.Now(), false)
-			task.LastTaskID = ""
+
+		if deleted[task.LastTaskID] {
+			log.Printf("Todo %s of task %s was deleted, applying policy %q", task.LastTaskID, task.ID, task.OnDelete)
+			todo := habitrpg.Task{ID: task.LastTaskID}
+			h.addHistory(task, outcomeDeleted, time.Now())
+			task.todoDeleted()
+			changed = true
+			rescheduled = append(rescheduled, task.ID)
+			occurred = append(occurred, newEvent(eventOccurrenceDeleted, h.accountID, task, &todo))
 		}
 	}
-	return nil
+
+	rearmScheduler(h.accountID, rescheduled...)
+	return err
+}
+
+// fetchTodo reads a single todo from HabitRPG, errTodoNotFound is returned
+// if it does not exist (anymore)
+func (h *HabitTaskStore) fetchTodo(idOrAlias string) (*habitrpg.Task, error) {
+	res := struct {
+		Data habitrpg.Task `json:"data"`
+	}{}
+
+	err := h.doHTTPRequest("GET", "application/json", "/tasks/"+url.PathEscape(idOrAlias), nil, &res)
+	switch {
+	case err == nil:
+		return &res.Data, nil
+	case isNotFound(err):
+		return nil, errTodoNotFound
+	default:
+		return nil, err
+	}
+}
+
+// triggerTask makes the task due now so the scheduler creates its todo and
+// publishes the trigger event. It returns false if the task does not exist,
+// saving the change is left to the caller.
+func (h *HabitTaskStore) triggerTask(id string) bool {
+	var triggered *HabitTask
+	h.lock.Lock()
+	if task := h.task(id); task != nil {
+		task.NextEntryDate = time.Now()
+		t := *task
+		triggered = &t
+	}
+	h.lock.Unlock()
+
+	if triggered == nil {
+		return false
+	}
+
+	rearmScheduler(h.accountID, id)
+	publishEvent(newEvent(eventTaskTriggered, h.accountID, triggered, nil))
+	return true
 }
 
+// CreateDueTasks creates the todos of all due tasks, used as a safety sweep
+// next to the scheduler
 func (h *HabitTaskStore) CreateDueTasks() error {
-	log.Println("Creating tasks...")
+	log.Printf("Creating tasks for account %s...", h.accountID)
+	_, err := h.createDueTasks(nil)
+	return err
+}
+
+// createDueTasks queues the creation of the todos of the given tasks (all if
+// taskIDs is nil) in case they are due, executes the outbox and returns the
+// IDs of the tasks whose creation was queued. Failed creations are retried
+// by the outbox worker.
+func (h *HabitTaskStore) createDueTasks(taskIDs []string) ([]string, error) {
+	var filter map[string]bool
+	if taskIDs != nil {
+		filter = map[string]bool{}
+		for _, id := range taskIDs {
+			filter[id] = true
+		}
+	}
+
+	created := []string{}
+
+	h.lock.Lock()
 	for i, _ := range h.Tasks {
 		task := &h.Tasks[i]
-		if task.IsCompleted && time.Now().After(task.NextEntryDate) {
-			newTask := habitrpg.Task{
-				Type:        "todo",
-				Text:        task.Title,
-				DateCreated: time.Now(),
-			}
-
-			buf := bytes.NewBuffer([]byte{})
-			if err := json.NewEncoder(buf).Encode(newTask); err != nil {
-				return fmt.Errorf("Unable to encode new task: %s", err)
-			}
+		if filter != nil && !filter[task.ID] {
+			continue
+		}
 
-			res := struct {
-				Data habitrpg.Task `json:"data"`
-			}{}
-			if err := h.doHTTPRequest("POST", "application/json", "/tasks/user", buf, &res); err != nil {
-				return fmt.Errorf("Unable to create new task with API: %s", err)
-			}
+		if task.IsCompleted && !task.IsPaused && time.Now().After(task.NextEntryDate) {
+			op := h.enqueue(OutboxOperation{
+				Kind:   outboxCreate,
+				TaskID: task.ID,
+				Alias:  task.occurrenceAlias(),
+				Text:   task.Title,
+				Due:    task.NextEntryDate,
+			})
 
-			task.LastTaskID = res.Data.ID
 			task.IsCompleted = false
+			task.LastTaskID = ""
+			task.PendingCreate = op.ID
+			task.OverdueReported = false
+			created = append(created, task.ID)
 		}
 	}
-	return nil
+	h.lock.Unlock()
+
+	if len(created) == 0 {
+		return created, nil
+	}
+	return created, h.processOutbox(false)
+}
+
+// createTodo creates a todo with the alias of an occurrence due at the given
+// time and returns it. If a todo with that alias already exists it was
+// created by an earlier attempt whose result got lost and it is adopted
+// instead of creating a duplicate.
+func (h *HabitTaskStore) createTodo(alias, text string, due time.Time) (*habitrpg.Task, error) {
+	existing, err := h.fetchTodo(alias)
+	switch {
+	case err == nil:
+		log.Printf("Adopting existing todo %s for occurrence %s", existing.ID, alias)
+		metricTodosAdopted.Inc(h.accountID)
+		return existing, nil
+	case err == errTodoNotFound:
+		// No todo for this occurrence yet
+	default:
+		return nil, fmt.Errorf("Unable to look up todo %s: %s", alias, err)
+	}
+
+	newTask := habitrpg.Task{
+		Type:        "todo",
+		Alias:       alias,
+		Text:        text,
+		DateCreated: due,
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := json.NewEncoder(buf).Encode(newTask); err != nil {
+		return nil, fmt.Errorf("Unable to encode new task: %s", err)
+	}
+
+	res := struct {
+		Data habitrpg.Task `json:"data"`
+	}{}
+	if err := h.doHTTPRequest("POST", "application/json", "/tasks/user", buf, &res); err != nil {
+		return nil, fmt.Errorf("Unable to create new task with API: %s", err)
+	}
+	metricTodosCreated.Inc(h.accountID)
+
+	return &res.Data, nil
 }
 
 type HabitTask struct {
@@ -163,13 +536,90 @@ type HabitTask struct {
 	LastTaskID    string
 	NextEntryDate time.Time
 	IsCompleted   bool
+	IsPaused      bool
+
+	LastCompletedDate time.Time
 
 	RepeatHours     int
 	RepeatCron      bool
 	RepeatCronEntry string
+
+	OnDelete        string
+	LastOutcome     string
+	LastDeletedDate time.Time
+
+	// OverdueHours overrides --overdue-after for the task
+	OverdueHours int `json:",omitempty"`
+	// NotifyEmails receive an email for the events listed in NotifyOn
+	NotifyEmails []string `json:",omitempty"`
+	NotifyOn     []string `json:",omitempty"`
+
+	// PendingCreate is the outbox operation creating the todo of the current
+	// occurrence while LastTaskID is not known yet
+	PendingCreate string `json:",omitempty"`
+	// OverdueReported is set once the overdue event of the current
+	// occurrence was published
+	OverdueReported bool `json:",omitempty"`
 }
 
 func NewTaskWithChecks(input []byte) (*HabitTask, error) {
+	out, err := parseTaskInput(input)
+	if err != nil {
+		return nil, err
+	}
+
+	out.ID = uuid.NewV4().String()
+	out.IsCompleted = true
+	out.updateNextEntryTime(time.Now(), true)
+
+	return out, nil
+}
+
+// UpdateWithChecks applies the user controllable fields from input to the
+// task. If the schedule changed while the task is waiting for its next entry
+// the entry date is calculated again using the new schedule.
+func (t *HabitTask) UpdateWithChecks(input []byte) error {
+	upd, err := parseTaskInput(input)
+	if err != nil {
+		return err
+	}
+
+	scheduleChanged := t.RepeatHours != upd.RepeatHours ||
+		t.RepeatCron != upd.RepeatCron ||
+		t.RepeatCronEntry != upd.RepeatCronEntry
+
+	t.Title = upd.Title
+	t.OnDelete = upd.OnDelete
+	t.RepeatHours = upd.RepeatHours
+	t.RepeatCron = upd.RepeatCron
+	t.RepeatCronEntry = upd.RepeatCronEntry
+	t.OverdueHours = upd.OverdueHours
+	t.NotifyEmails = upd.NotifyEmails
+	t.NotifyOn = upd.NotifyOn
+
+	if scheduleChanged && t.IsCompleted {
+		t.updateNextEntryTime(t.LastCompletedDate, t.LastCompletedDate.IsZero())
+	}
+
+	return nil
+}
+
+// PreviewEntryDates returns the next count entry dates for the schedule of
+// the task assuming every occurrence gets completed right when it is created
+func (t HabitTask) PreviewEntryDates(count int) []time.Time {
+	dates := []time.Time{}
+
+	t.updateNextEntryTime(time.Now(), true)
+	for len(dates) < count && !t.NextEntryDate.IsZero() {
+		dates = append(dates, t.NextEntryDate)
+		t.updateNextEntryTime(t.NextEntryDate, false)
+	}
+
+	return dates
+}
+
+// parseTaskInput reads and validates the user controllable fields of a task
+func parseTaskInput(input []byte) (*HabitTask, error) {
 	tmp := HabitTask{}
 	err := json.Unmarshal(input, &tmp)
 	if err != nil {
@@ -177,11 +627,20 @@ func NewTaskWithChecks(input []byte) (*HabitTask, error) {
 	}
 
 	out := &HabitTask{
-		ID:          uuid.NewV4().String(),
-		Title:       tmp.Title,
-		IsCompleted: true,
-		RepeatHours: tmp.RepeatHours,
-		RepeatCron:  false,
+		Title:        tmp.Title,
+		RepeatHours:  tmp.RepeatHours,
+		RepeatCron:   false,
+		OnDelete:     tmp.OnDelete,
+		OverdueHours: tmp.OverdueHours,
+		NotifyEmails: tmp.NotifyEmails,
+		NotifyOn:     tmp.NotifyOn,
+	}
+
+	if out.OnDelete == "" {
+		out.OnDelete = onDeleteSkip
+	}
+	if !validOnDelete(out.OnDelete) {
+		return nil, fmt.Errorf("OnDelete must be one of %s, %s or %s", onDeleteSkip, onDeleteRecreate, onDeletePause)
 	}
 
 	if tmp.RepeatCron && len(tmp.RepeatCronEntry) > 0 {
@@ -194,15 +653,89 @@ func NewTaskWithChecks(input []byte) (*HabitTask, error) {
 		out.RepeatCronEntry = tmp.RepeatCronEntry
 	}
 
+	if out.RepeatHours < 0 {
+		return nil, fmt.Errorf("RepeatHours must not be negative")
+	}
+
+	if out.OverdueHours < 0 {
+		return nil, fmt.Errorf("OverdueHours must not be negative")
+	}
+
+	if len(out.NotifyEmails) > 0 && len(out.NotifyOn) == 0 {
+		out.NotifyOn = []string{notifyCreated, notifyOverdue}
+	}
+	if err := validateNotifications(out.NotifyEmails, out.NotifyOn); err != nil {
+		return nil, err
+	}
+
 	if out.RepeatHours == 0 && out.RepeatCron == false {
 		return nil, fmt.Errorf("You must specify at least one of RepeatHours or RepeatCronEntry")
 	}
 
-	out.updateNextEntryTime(time.Now(), true)
-
 	return out, nil
 }
 
+// todoDeleted handles the todo of the open occurrence having been deleted in
+// HabitRPG according to the OnDelete policy of the task
+func (t *HabitTask) todoDeleted() {
+	now := time.Now()
+
+	t.IsCompleted = true
+	t.LastTaskID = ""
+	t.LastOutcome = outcomeDeleted
+	t.LastDeletedDate = now
+
+	switch t.OnDelete {
+	case onDeleteRecreate:
+		// NextEntryDate is still the one of the deleted occurrence so the
+		// next run creates it again
+	case onDeletePause:
+		t.IsPaused = true
+		t.updateNextEntryTime(now, false)
+	default:
+		t.updateNextEntryTime(now, false)
+	}
+}
+
+func validOnDelete(policy string) bool {
+	switch policy {
+	case onDeleteSkip, onDeleteRecreate, onDeletePause:
+		return true
+	}
+	return false
+}
+
+// OccurrenceRecord describes how an occurrence of a task ended
+type OccurrenceRecord struct {
+	TaskID  string
+	TodoID  string
+	Due     time.Time
+	Outcome string
+	Time    time.Time
+}
+
+// addHistory records the end of the open occurrence of the task, it has to
+// be called before the task is rescheduled. The store must be locked by the
+// caller.
+func (h *HabitTaskStore) addHistory(task *HabitTask, outcome string, at time.Time) {
+	h.History = append(h.History, OccurrenceRecord{
+		TaskID:  task.ID,
+		TodoID:  task.LastTaskID,
+		Due:     task.NextEntryDate,
+		Outcome: outcome,
+		Time:    at,
+	})
+	if len(h.History) > historySize {
+		h.History = h.History[len(h.History)-historySize:]
+	}
+}
+
+// occurrenceAlias returns the alias of the todo created for the current
+// occurrence, it is derived from the task ID and the entry date
+func (t HabitTask) occurrenceAlias() string {
+	return fmt.Sprintf("%s%s-%d", occurrenceAliasPrefix, t.ID, t.NextEntryDate.Unix())
+}
+
 func (t *HabitTask) updateNextEntryTime(dateCompleted time.Time, initial bool) {
 	if initial {
 		t.NextEntryDate = time.Now()
@@ -215,3 +748,25 @@ func (t *HabitTask) updateNextEntryTime(dateCompleted time.Time, initial bool) {
 		t.NextEntryDate = scheduler.Next(t.NextEntryDate)
 	}
 }
+
+func (t HabitTask) scheduleString() string {
+	parts := []string{}
+	if t.RepeatHours > 0 {
+		parts = append(parts, fmt.Sprintf("%dh after completion", t.RepeatHours))
+	}
+	if t.RepeatCron {
+		parts = append(parts, fmt.Sprintf("cron %q", t.RepeatCronEntry))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (t HabitTask) stateString() string {
+	switch {
+	case t.IsPaused:
+		return "paused"
+	case !t.IsCompleted:
+		return "open"
+	default:
+		return "waiting"
+	}
+}
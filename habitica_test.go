@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+	"github.com/satori/go.uuid"
+)
+
+// fakeHabitica serves the parts of the HabitRPG API used by the stores and
+// keeps the todos in memory
+type fakeHabitica struct {
+	srv *httptest.Server
+
+	lock     sync.Mutex
+	todos    []*habitrpg.Task
+	requests []string
+	fail     int // Status to respond to every request with if set
+}
+
+func newFakeHabitica(t *testing.T) *fakeHabitica {
+	f := &fakeHabitica{}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeHabitica) serve(res http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if f.fail != 0 {
+		http.Error(res, "Failing", f.fail)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/tasks/")
+	switch {
+	case r.Method == "GET" && path == "user":
+		todos := []habitrpg.Task{}
+		for _, t := range f.todos {
+			todos = append(todos, *t)
+		}
+		f.respond(res, todos)
+
+	case r.Method == "POST" && path == "user":
+		todo := habitrpg.Task{}
+		if err := json.NewDecoder(r.Body).Decode(&todo); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if todo.Alias != "" && f.todo(todo.Alias) != nil {
+			http.Error(res, "Alias already used", http.StatusBadRequest)
+			return
+		}
+		todo.ID = uuid.NewV4().String()
+		f.todos = append(f.todos, &todo)
+		f.respond(res, todo)
+
+	case strings.HasSuffix(path, "/score/up"):
+		todo := f.todo(strings.TrimSuffix(path, "/score/up"))
+		if todo == nil {
+			http.NotFound(res, r)
+			return
+		}
+		todo.Completed = true
+		f.respond(res, nil)
+
+	default:
+		todo := f.todo(path)
+		if todo == nil {
+			http.NotFound(res, r)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			f.respond(res, todo)
+		case "PUT":
+			update := habitrpg.Task{}
+			json.NewDecoder(r.Body).Decode(&update)
+			todo.Text = update.Text
+			f.respond(res, todo)
+		case "DELETE":
+			for i := range f.todos {
+				if f.todos[i] == todo {
+					f.todos = append(f.todos[:i], f.todos[i+1:]...)
+					break
+				}
+			}
+			f.respond(res, nil)
+		}
+	}
+}
+
+func (f *fakeHabitica) respond(res http.ResponseWriter, data interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]interface{}{"success": true, "data": data})
+}
+
+// todo returns the todo by ID or alias. The lock must be held by the caller.
+func (f *fakeHabitica) todo(idOrAlias string) *habitrpg.Task {
+	for _, t := range f.todos {
+		if t.ID == idOrAlias || (t.Alias != "" && t.Alias == idOrAlias) {
+			return t
+		}
+	}
+	return nil
+}
+
+// addTodo creates an open todo as if the user created it in HabitRPG
+func (f *fakeHabitica) addTodo(text string) *habitrpg.Task {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	todo := &habitrpg.Task{ID: uuid.NewV4().String(), Type: "todo", Text: text, DateCreated: time.Now()}
+	f.todos = append(f.todos, todo)
+	c := *todo
+	return &c
+}
+
+// openTodos returns the texts of the todos not completed yet
+func (f *fakeHabitica) openTodos() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	texts := []string{}
+	for _, t := range f.todos {
+		if !t.Completed {
+			texts = append(texts, t.Text)
+		}
+	}
+	return texts
+}
+
+// newTestStore creates the store of the default account keeping its data in
+// a journal in a temporary directory and talking to the fake
+func newTestStore(t *testing.T, f *fakeHabitica, dir string) *HabitTaskStore {
+	t.Helper()
+
+	st, err := openJournalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.Close)
+
+	store := NewHabitTaskStore(st, Account{ID: defaultAccountID, HabitRPGUserID: "user", HabitRPGAPIToken: "token"})
+	store.client.BaseURL = f.srv.URL
+	if err := store.Load(); err != nil {
+		t.Fatalf("Unable to load store: %s", err)
+	}
+	return store
+}
@@ -0,0 +1,178 @@
+package habitrpg
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// States of a Breaker
+const (
+	BreakerClosed   = "closed"    // Requests are sent
+	BreakerOpen     = "open"      // Requests fail right away
+	BreakerHalfOpen = "half-open" // A probe checks whether the API is back
+)
+
+// ErrCircuitOpen is returned for requests not sent because the API failed
+// repeatedly
+var ErrCircuitOpen = errors.New("HabitRPG API is unavailable (circuit breaker open)")
+
+// Breaker stops sending requests after the API failed Failures times in a
+// row. While it is open the API is probed every OpenFor, the first successful
+// probe or request closes it again. A Breaker can be shared by multiple
+// clients.
+type Breaker struct {
+	Failures int
+	OpenFor  time.Duration
+
+	// Probe checks whether the API is available again, if it is nil the first
+	// request after OpenFor is used as probe
+	Probe func() error
+	// OnChange is called with the new state whenever it changes
+	OnChange func(state string)
+
+	lock      sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	lastError string
+	probing   bool
+}
+
+// BreakerStatus describes the current state of a Breaker
+type BreakerStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	NextProbe *time.Time `json:"next_probe,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// NewBreaker creates a closed breaker
+func NewBreaker(failures int, openFor time.Duration) *Breaker {
+	return &Breaker{
+		Failures: failures,
+		OpenFor:  openFor,
+		state:    BreakerClosed,
+	}
+}
+
+// Status returns the current state
+func (b *Breaker) Status() BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s := BreakerStatus{
+		State:     b.state,
+		Failures:  b.failures,
+		LastError: b.lastError,
+	}
+	if b.state != BreakerClosed {
+		openedAt, nextProbe := b.openedAt, b.openedAt.Add(b.OpenFor)
+		s.OpenedAt, s.NextProbe = &openedAt, &nextProbe
+	}
+	return s
+}
+
+// Closed reports whether requests are sent
+func (b *Breaker) Closed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state == BreakerClosed
+}
+
+// allow returns ErrCircuitOpen if the request must not be sent. Without a
+// Probe function the first request after OpenFor is let through as probe.
+func (b *Breaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch {
+	case b.state == BreakerClosed:
+		return nil
+	case b.Probe == nil && !b.probing && time.Since(b.openedAt) >= b.OpenFor:
+		b.probing = true
+		b.setState(BreakerHalfOpen)
+		return nil
+	}
+	return ErrCircuitOpen
+}
+
+// record updates the breaker with the result of a request
+func (b *Breaker) record(err error) {
+	if err == ErrCircuitOpen {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !isAvailabilityError(err) {
+		b.failures = 0
+		b.lastError = ""
+		b.probing = false
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+
+	switch {
+	case b.state == BreakerHalfOpen:
+		b.probing = false
+		b.open()
+	case b.state == BreakerClosed && b.failures >= b.Failures:
+		b.open()
+	}
+}
+
+// open must be called with the lock held
+func (b *Breaker) open() {
+	b.openedAt = time.Now()
+	b.setState(BreakerOpen)
+
+	if b.Probe != nil {
+		time.AfterFunc(b.OpenFor, b.probe)
+	}
+}
+
+func (b *Breaker) probe() {
+	b.lock.Lock()
+	if b.state != BreakerOpen {
+		b.lock.Unlock()
+		return
+	}
+	b.setState(BreakerHalfOpen)
+	b.lock.Unlock()
+
+	b.record(b.Probe())
+}
+
+// setState must be called with the lock held
+func (b *Breaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+
+	if b.OnChange != nil {
+		go b.OnChange(state)
+	}
+}
+
+// isAvailabilityError tells failures caused by the API being unavailable
+// (no response, server errors or rate limiting) from errors caused by the
+// request itself which show the API is working
+func isAvailabilityError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == 429
+	}
+	return true
+}
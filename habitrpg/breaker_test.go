@@ -0,0 +1,214 @@
+package habitrpg
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testOpenFor = 20 * time.Millisecond
+
+var errUnavailable = errors.New("connection refused")
+
+// watchStates collects the states passed to OnChange
+func watchStates(b *Breaker) func(n int) []string {
+	states := make(chan string, 10)
+	b.OnChange = func(state string) { states <- state }
+
+	return func(n int) []string {
+		got := []string{}
+		for len(got) < n {
+			select {
+			case s := <-states:
+				got = append(got, s)
+			case <-time.After(time.Second):
+				return got
+			}
+		}
+		return got
+	}
+}
+
+func expectStates(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected transitions %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected transitions %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestBreakerOpensAfterFailures(t *testing.T) {
+	b := NewBreaker(3, time.Hour)
+	states := watchStates(b)
+
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("Request %d was refused: %s", i, err)
+		}
+		b.record(errUnavailable)
+	}
+	if !b.Closed() {
+		t.Fatal("Breaker opened before reaching the failure limit")
+	}
+
+	// A success resets the count of failures in a row
+	b.record(nil)
+	for i := 0; i < 3; i++ {
+		b.record(errUnavailable)
+	}
+	expectStates(t, states(1), BreakerOpen)
+
+	if err := b.allow(); err != ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen while open, got %v", err)
+	}
+
+	s := b.Status()
+	if s.State != BreakerOpen || s.Failures != 3 || s.LastError != errUnavailable.Error() || s.NextProbe == nil {
+		t.Errorf("Unexpected status %+v", s)
+	}
+}
+
+func TestBreakerIgnoresClientErrors(t *testing.T) {
+	b := NewBreaker(1, time.Hour)
+
+	for _, code := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound} {
+		b.record(StatusError{StatusCode: code})
+	}
+	b.record(ErrCircuitOpen)
+	if !b.Closed() {
+		t.Fatal("Breaker was opened by errors of the request")
+	}
+
+	for _, code := range []int{http.StatusInternalServerError, http.StatusTooManyRequests} {
+		b := NewBreaker(1, time.Hour)
+		b.record(StatusError{StatusCode: code})
+		if b.Closed() {
+			t.Errorf("Breaker was not opened by status %d", code)
+		}
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b := NewBreaker(1, testOpenFor)
+	states := watchStates(b)
+
+	b.record(errUnavailable)
+	expectStates(t, states(1), BreakerOpen)
+	if err := b.allow(); err != ErrCircuitOpen {
+		t.Fatalf("Request was let through before OpenFor passed: %v", err)
+	}
+
+	time.Sleep(testOpenFor)
+
+	var allowed int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.allow() == nil {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Fatalf("Expected a single probe in half-open, %d requests were let through", allowed)
+	}
+	expectStates(t, states(1), BreakerHalfOpen)
+
+	// A failed probe opens the breaker again
+	b.record(errUnavailable)
+	expectStates(t, states(1), BreakerOpen)
+
+	time.Sleep(testOpenFor)
+	if err := b.allow(); err != nil {
+		t.Fatalf("Second probe was refused: %s", err)
+	}
+	expectStates(t, states(1), BreakerHalfOpen)
+	b.record(nil)
+	expectStates(t, states(1), BreakerClosed)
+
+	if s := b.Status(); s.Failures != 0 || s.LastError != "" || s.NextProbe != nil {
+		t.Errorf("Closed breaker kept failure state: %+v", s)
+	}
+}
+
+func TestBreakerProbeFunction(t *testing.T) {
+	var probes, failProbes int32 = 0, 1
+
+	b := NewBreaker(1, testOpenFor)
+	b.Probe = func() error {
+		atomic.AddInt32(&probes, 1)
+		if atomic.AddInt32(&failProbes, -1) >= 0 {
+			return errUnavailable
+		}
+		return nil
+	}
+	states := watchStates(b)
+
+	b.record(errUnavailable)
+
+	// Requests are not used as probes if a Probe function is set
+	time.Sleep(testOpenFor / 2)
+	for i := 0; i < 3; i++ {
+		if err := b.allow(); err != ErrCircuitOpen {
+			t.Fatalf("Request was let through while open: %v", err)
+		}
+	}
+
+	// OnChange is called asynchronously so only the number of transitions
+	// is checked
+	counts := map[string]int{}
+	for _, s := range states(5) {
+		counts[s]++
+	}
+	if counts[BreakerOpen] != 2 || counts[BreakerHalfOpen] != 2 || counts[BreakerClosed] != 1 {
+		t.Fatalf("Expected to open twice, probe twice and close once, got %v", counts)
+	}
+	if p := atomic.LoadInt32(&probes); p != 2 {
+		t.Errorf("Expected 2 probes, got %d", p)
+	}
+	if err := b.allow(); err != nil {
+		t.Errorf("Request refused after successful probe: %s", err)
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	var status int32 = http.StatusNotFound
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		res.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	c := NewClient("user", "token")
+	c.BaseURL = srv.URL
+	c.Breaker = NewBreaker(2, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Do("GET", "application/json", "/tasks/user", nil, nil); err == nil {
+			t.Fatal("Expected status error")
+		}
+	}
+	if !c.Breaker.Closed() {
+		t.Fatal("Not found responses opened the breaker")
+	}
+
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	for i := 0; i < 2; i++ {
+		c.Do("GET", "application/json", "/tasks/user", nil, nil)
+	}
+	if err := c.Do("GET", "application/json", "/tasks/user", nil, nil); err != ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen after server errors, got %v", err)
+	}
+}
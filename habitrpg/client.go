@@ -0,0 +1,127 @@
+package habitrpg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultBaseURL = "https://habitrpg.com:443/api/v3"
+	defaultTimeout = 30 * time.Second
+)
+
+// StatusError is returned when the API responds with an error status code
+type StatusError struct {
+	StatusCode int
+}
+
+func (s StatusError) Error() string {
+	return fmt.Sprintf("Unexpected status code received: %d", s.StatusCode)
+}
+
+// Client talks to the HabitRPG API using the credentials of one user
+type Client struct {
+	UserID   string
+	APIToken string
+
+	BaseURL    string
+	HTTPClient *http.Client
+
+	// Observer is called after every request with the status code
+	// received (0 if no response was received) and the request duration
+	Observer func(method, path string, statusCode int, duration time.Duration)
+
+	// Breaker stops sending requests while the API is unavailable
+	Breaker *Breaker
+}
+
+// NewClient creates a client for the user identified by userID and apiToken
+func NewClient(userID, apiToken string) *Client {
+	return &Client{
+		UserID:     userID,
+		APIToken:   apiToken,
+		BaseURL:    defaultBaseURL,
+		HTTPClient: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// Do executes a request against the API path urlStr and decodes the JSON
+// response into targetVar unless it is nil
+func (c *Client) Do(method, contentType, urlStr string, body io.Reader, targetVar interface{}) (err error) {
+	if c.UserID == "" || c.APIToken == "" {
+		return fmt.Errorf("No HabitRPG credentials configured")
+	}
+
+	if c.Breaker != nil {
+		if err := c.Breaker.allow(); err != nil {
+			return err
+		}
+		defer func() { c.Breaker.record(err) }()
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+urlStr, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("x-api-key", c.APIToken)
+	req.Header.Add("x-api-user", c.UserID)
+	req.Header.Add("Content-Type", contentType)
+
+	start := time.Now()
+	res, err := c.HTTPClient.Do(req)
+	if c.Observer != nil {
+		statusCode := 0
+		if err == nil {
+			statusCode = res.StatusCode
+		}
+		c.Observer(method, urlStr, statusCode, time.Since(start))
+	}
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return StatusError{StatusCode: res.StatusCode}
+	}
+
+	if targetVar == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(targetVar); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Status checks whether the API is up, it needs no credentials and is not
+// affected by the Breaker
+func (c *Client) Status() error {
+	res, err := c.HTTPClient.Get(c.BaseURL + "/status")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return StatusError{StatusCode: res.StatusCode}
+	}
+
+	status := struct {
+		Data struct {
+			Status string `json:"status"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return err
+	}
+	if status.Data.Status != "up" {
+		return fmt.Errorf("API reports status %q", status.Data.Status)
+	}
+	return nil
+}
@@ -55,6 +55,7 @@ type TaskChecklistEntry struct {
 type Task struct {
 	// General
 	ID          string        `json:"id,omitempty"`
+	Alias       string        `json:"alias,omitempty"`
 	Type        string        `json:"type,omitempty"`
 	DateCreated time.Time     `json:"dateCreated,omitempty"`
 	Text        string        `json:"text,omitempty"`
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+const (
+	checkOK      = "ok"
+	checkFail    = "fail"
+	checkSkipped = "skipped"
+)
+
+type checkResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func writeHealth(res http.ResponseWriter, resp healthResponse) {
+	status := http.StatusOK
+	if resp.Status != checkOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	data, _ := json.Marshal(resp)
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(status)
+	res.Write(data)
+}
+
+// handleHealthz reports the process is alive and able to serve requests
+func handleHealthz(res http.ResponseWriter, r *http.Request) {
+	writeHealth(res, healthResponse{Status: checkOK})
+}
+
+// handleReadyz checks the dependencies needed to do the scheduling: the store
+// needs to be loaded, Redis needs to be reachable, saving must not have been
+// failing for longer than --persist-alert-after and every account having
+// credentials needs to have fetched its task states successfully within
+// --ready-update-threshold without HabitRPG rejecting its credentials.
+// Followers only need Redis.
+func handleReadyz(res http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: checkOK, Checks: map[string]checkResult{}}
+	check := func(name string, result checkResult) {
+		resp.Checks[name] = result
+		if result.Status == checkFail {
+			resp.Status = checkFail
+		}
+	}
+
+	if !storeReady.Load() {
+		check("store", checkResult{Status: checkFail, Message: "Store is not loaded yet"})
+		writeHealth(res, resp)
+		return
+	}
+
+	if err := dataStorage.Ping(); err != nil {
+		check(dataStorage.Name(), checkResult{Status: checkFail, Message: err.Error()})
+	} else {
+		check(dataStorage.Name(), checkResult{Status: checkOK})
+	}
+
+	if !isLeader() {
+		// Followers neither save nor talk to HabitRPG, they are ready as long
+		// as they can read the state written by the leader
+		check("leader", checkResult{Status: checkSkipped, Message: "Following " + leadership.Leader()})
+		writeHealth(res, resp)
+		return
+	}
+
+	if failingFor := persistence.FailingFor(); failingFor > config.PersistAlertAfter {
+		check("persistence", checkResult{Status: checkFail, Message: "Saving failed for " + failingFor.Truncate(time.Second).String() + ": " + persistence.LastError()})
+	} else {
+		check("persistence", checkResult{Status: checkOK})
+	}
+
+	for _, store := range accounts.Stores() {
+		prefix := "account:" + store.accountID + ":"
+
+		if !store.hasCredentials() {
+			check(prefix+"credentials", checkResult{Status: checkSkipped, Message: "No HabitRPG credentials configured"})
+			continue
+		}
+
+		health := store.Health()
+
+		if health.CredentialsRejected {
+			check(prefix+"credentials", checkResult{Status: checkFail, Message: "HabitRPG rejected the credentials"})
+		} else {
+			check(prefix+"credentials", checkResult{Status: checkOK})
+		}
+
+		lastSuccess := health.LastUpdateSuccess
+		if lastSuccess.IsZero() {
+			// Give the first update some time to happen after start
+			lastSuccess = startedAt
+		}
+		if since := time.Since(lastSuccess); since > config.ReadyUpdateThreshold {
+			msg := "No successful update since " + since.Truncate(time.Second).String()
+			if health.LastUpdateError != "" {
+				msg += ": " + health.LastUpdateError
+			}
+			check(prefix+"update_states", checkResult{Status: checkFail, Message: msg})
+		} else {
+			check(prefix+"update_states", checkResult{Status: checkOK})
+		}
+	}
+
+	writeHealth(res, resp)
+}
+
+func handleInfo(res http.ResponseWriter, r *http.Request) {
+	info := map[string]interface{}{
+		"version":    version,
+		"go_version": runtime.Version(),
+		"started_at": startedAt,
+		"leader":     isLeader(),
+	}
+	if habiticaBreaker != nil {
+		info["habitica"] = habiticaBreaker.Status().State
+	}
+	if mqttClient != nil {
+		info["mqtt"] = "disconnected"
+		if mqttClient.Connected() {
+			info["mqtt"] = "connected"
+		}
+	}
+	if leadership != nil {
+		info["instance_id"] = leadership.instanceID
+		info["current_leader"] = leadership.Leader()
+	}
+
+	data, _ := json.Marshal(info)
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(data)
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The journal storage keeps the data in files for deployments without Redis.
+// The account registry is small and rewritten as a whole. Every save of a
+// task store is appended to the journal of the store as a batch of entries:
+// the tasks changed or deleted since the last save and the other fields of
+// the document if they changed. Loading replays the journal on top of the
+// last snapshot, after --journal-compact-entries entries the journal is
+// compacted into a new snapshot. The compacted journal is renamed to a segment
+// "<name>.journal.<seq>" named after its last entry, the newest
+// --journal-keep-segments segments are kept as history of the changes.
+//
+// Every journal line has the format "<crc32c> <entry JSON>". Only the last
+// entry of a batch has Commit set and a batch is only applied if that entry
+// was written completely, a save interrupted by a crash is dropped as a whole
+// and the torn end of the journal is truncated. Damage before the end of the
+// journal is not repaired but reported as an error.
+
+const (
+	journalOpHeader = "header" // Data holds the document without its tasks
+	journalOpPut    = "put"    // Data holds the task, created or replaced
+	journalOpDelete = "delete" // The task was removed
+)
+
+type journalEntry struct {
+	Seq    uint64
+	Time   time.Time
+	Op     string
+	TaskID string          `json:",omitempty"`
+	Data   json.RawMessage `json:",omitempty"`
+	Commit bool            `json:",omitempty"`
+}
+
+type journalSnapshot struct {
+	Seq      uint64 // Last journal entry contained in the snapshot
+	Time     time.Time
+	Checksum uint32 // CRC32-C of Document
+	Document json.RawMessage
+}
+
+var journalCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type journalStorage struct {
+	dir      string
+	journals map[string]*taskJournal
+	lock     sync.Mutex
+}
+
+func openJournalStorage(dir string) (*journalStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create journal directory: %s", err)
+	}
+
+	return &journalStorage{
+		dir:      dir,
+		journals: map[string]*taskJournal{},
+	}, nil
+}
+
+func (s *journalStorage) Name() string { return storageJournal }
+
+func (s *journalStorage) path(key string) string {
+	return filepath.Join(s.dir, strings.Replace(key, ":", ".", -1))
+}
+
+func (s *journalStorage) Get(key string) ([]byte, error) {
+	if key == registryKey() {
+		data, err := ioutil.ReadFile(s.path(key) + ".json")
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return data, err
+	}
+
+	j, err := s.journal(key)
+	if err != nil {
+		return nil, err
+	}
+	return j.document()
+}
+
+func (s *journalStorage) Set(key string, value []byte) error {
+	if key == registryKey() {
+		return writeFileAtomic(s.path(key)+".json", value)
+	}
+
+	j, err := s.journal(key)
+	if err != nil {
+		return err
+	}
+	return j.commit(value)
+}
+
+func (s *journalStorage) Del(key string) error {
+	if key == registryKey() {
+		return removeIfExists(s.path(key) + ".json")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if j, ok := s.journals[key]; ok {
+		j.close()
+		delete(s.journals, key)
+	}
+
+	if err := removeIfExists(s.path(key) + ".journal"); err != nil {
+		return err
+	}
+	if err := removeIfExists(s.path(key) + ".snapshot"); err != nil {
+		return err
+	}
+	return pruneJournalSegments(s.path(key), 0)
+}
+
+// Ping checks the journal directory is still writable
+func (s *journalStorage) Ping() error {
+	f, err := ioutil.TempFile(s.dir, ".ping")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (s *journalStorage) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, j := range s.journals {
+		j.close()
+		delete(s.journals, key)
+	}
+}
+
+// journal returns the opened journal for the key, opening and replaying it
+// on first use
+func (s *journalStorage) journal(key string) (*taskJournal, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if j, ok := s.journals[key]; ok {
+		return j, nil
+	}
+
+	j, err := openTaskJournal(s.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open journal for %s: %s", key, err)
+	}
+	s.journals[key] = j
+	return j, nil
+}
+
+// taskJournal holds the journal file of a task store together with the
+// document it describes
+type taskJournal struct {
+	path string
+	file *os.File
+	size int64
+
+	seq     uint64 // Last entry written or replayed
+	entries int    // Entries in the journal file since the snapshot
+
+	header json.RawMessage
+	order  []string
+	tasks  map[string]json.RawMessage
+
+	lock sync.Mutex
+}
+
+func openTaskJournal(path string) (*taskJournal, error) {
+	j := &taskJournal{path: path, tasks: map[string]json.RawMessage{}}
+
+	if err := j.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path+".journal", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.file = f
+
+	if err := j.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *taskJournal) loadSnapshot() error {
+	data, err := ioutil.ReadFile(j.path + ".snapshot")
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	snap := journalSnapshot{}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("Snapshot is damaged: %s", err)
+	}
+	if crc32.Checksum(snap.Document, journalCRCTable) != snap.Checksum {
+		return fmt.Errorf("Snapshot is damaged: checksum mismatch")
+	}
+
+	header, order, tasks, err := splitStoreDocument(snap.Document)
+	if err != nil {
+		return fmt.Errorf("Snapshot is damaged: %s", err)
+	}
+
+	j.seq, j.header, j.order, j.tasks = snap.Seq, header, order, tasks
+	return nil
+}
+
+// replay applies all committed batches of the journal file and truncates an
+// incomplete batch at its end
+func (j *taskJournal) replay() error {
+	data, err := ioutil.ReadAll(j.file)
+	if err != nil {
+		return err
+	}
+
+	var (
+		offset    int
+		committed int // Offset after the last committed batch
+		pending   []journalEntry
+	)
+	for offset < len(data) {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			// Last line was not written completely
+			break
+		}
+
+		entry, err := parseJournalLine(data[offset : offset+end])
+		if err != nil {
+			if journalHasEntries(data[offset+end+1:]) {
+				return fmt.Errorf("Journal is damaged at offset %d: %s", offset, err)
+			}
+			// Only the end of the journal is damaged, treat it as torn write
+			break
+		}
+		offset += end + 1
+
+		pending = append(pending, entry)
+		if !entry.Commit {
+			continue
+		}
+
+		for _, e := range pending {
+			if e.Seq <= j.seq {
+				// Already contained in the snapshot
+				continue
+			}
+			if err := j.apply(e); err != nil {
+				return fmt.Errorf("Journal entry %d can not be applied: %s", e.Seq, err)
+			}
+		}
+		j.entries += len(pending)
+		pending = nil
+		committed = offset
+	}
+
+	if committed < len(data) {
+		log.Printf("Journal %s ends with an incomplete write, discarding %d bytes", j.path, len(data)-committed)
+		if err := j.file.Truncate(int64(committed)); err != nil {
+			return err
+		}
+		if err := j.file.Sync(); err != nil {
+			return err
+		}
+	}
+	j.size = int64(committed)
+
+	return nil
+}
+
+func parseJournalLine(line []byte) (journalEntry, error) {
+	entry := journalEntry{}
+
+	sep := bytes.IndexByte(line, ' ')
+	if sep < 0 {
+		return entry, fmt.Errorf("Missing checksum")
+	}
+
+	checksum, err := strconv.ParseUint(string(line[:sep]), 16, 32)
+	if err != nil {
+		return entry, fmt.Errorf("Invalid checksum: %s", err)
+	}
+	if crc32.Checksum(line[sep+1:], journalCRCTable) != uint32(checksum) {
+		return entry, fmt.Errorf("Checksum mismatch")
+	}
+
+	if err := json.Unmarshal(line[sep+1:], &entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// journalHasEntries reports whether data contains at least one valid line
+func journalHasEntries(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if _, err := parseJournalLine(line); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *taskJournal) apply(e journalEntry) error {
+	switch e.Op {
+	case journalOpHeader:
+		j.header = e.Data
+
+	case journalOpPut:
+		if _, ok := j.tasks[e.TaskID]; !ok {
+			j.order = append(j.order, e.TaskID)
+		}
+		j.tasks[e.TaskID] = e.Data
+
+	case journalOpDelete:
+		delete(j.tasks, e.TaskID)
+		for i, id := range j.order {
+			if id == e.TaskID {
+				j.order = append(j.order[:i], j.order[i+1:]...)
+				break
+			}
+		}
+
+	default:
+		return fmt.Errorf("Unknown operation %q", e.Op)
+	}
+
+	j.seq = e.Seq
+	return nil
+}
+
+// document assembles the current store document, nil if nothing was written
+func (j *taskJournal) document() ([]byte, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.documentLocked()
+}
+
+func (j *taskJournal) documentLocked() ([]byte, error) {
+	if j.header == nil && len(j.order) == 0 {
+		return nil, nil
+	}
+
+	doc := map[string]json.RawMessage{}
+	if j.header != nil {
+		if err := json.Unmarshal(j.header, &doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(j.order) > 0 {
+		tasks := make([]json.RawMessage, 0, len(j.order))
+		for _, id := range j.order {
+			tasks = append(tasks, j.tasks[id])
+		}
+		data, err := json.Marshal(tasks)
+		if err != nil {
+			return nil, err
+		}
+		doc["Tasks"] = data
+	}
+
+	return json.Marshal(doc)
+}
+
+// commit appends the differences between the document and the current state
+// of the journal as one batch and syncs it to disk
+func (j *taskJournal) commit(value []byte) error {
+	header, order, tasks, err := splitStoreDocument(value)
+	if err != nil {
+		return err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	batch := []journalEntry{}
+	now := time.Now()
+	add := func(e journalEntry) {
+		e.Seq = j.seq + uint64(len(batch)) + 1
+		e.Time = now
+		batch = append(batch, e)
+	}
+
+	if !bytes.Equal(header, j.header) {
+		add(journalEntry{Op: journalOpHeader, Data: header})
+	}
+	for _, id := range order {
+		if !bytes.Equal(tasks[id], j.tasks[id]) {
+			add(journalEntry{Op: journalOpPut, TaskID: id, Data: tasks[id]})
+		}
+	}
+	for _, id := range j.order {
+		if _, ok := tasks[id]; !ok {
+			add(journalEntry{Op: journalOpDelete, TaskID: id})
+		}
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+	batch[len(batch)-1].Commit = true
+
+	buf := new(bytes.Buffer)
+	for _, e := range batch {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "%08x %s\n", crc32.Checksum(data, journalCRCTable), data)
+	}
+
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		j.file.Truncate(j.size)
+		return fmt.Errorf("Unable to write journal: %s", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		j.file.Truncate(j.size)
+		return fmt.Errorf("Unable to sync journal: %s", err)
+	}
+	j.size += int64(buf.Len())
+	metricJournalEntries.Add(float64(len(batch)))
+
+	for _, e := range batch {
+		if err := j.apply(e); err != nil {
+			return err
+		}
+	}
+	j.entries += len(batch)
+
+	if j.entries >= config.JournalCompactEntries {
+		if err := j.compact(); err != nil {
+			// The journal is still complete, compaction is tried again on
+			// the next save
+			log.Printf("Unable to compact journal %s: %s", j.path, err)
+		}
+	}
+
+	return nil
+}
+
+// compact writes the current document as snapshot and starts a new journal.
+// If the process dies in between the journal entries already contained in
+// the snapshot are skipped on replay.
+func (j *taskJournal) compact() error {
+	doc, err := j.documentLocked()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(journalSnapshot{
+		Seq:      j.seq,
+		Time:     time.Now(),
+		Checksum: crc32.Checksum(doc, journalCRCTable),
+		Document: doc,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(j.path+".snapshot", data); err != nil {
+		return err
+	}
+
+	if err := j.rotate(); err != nil {
+		return err
+	}
+
+	log.Printf("Compacted %d entries of journal %s into a snapshot", j.entries, j.path)
+	metricJournalCompactions.Inc()
+	j.size, j.entries = 0, 0
+
+	if err := pruneJournalSegments(j.path, config.JournalKeepSegments); err != nil {
+		log.Printf("Unable to remove old segments of journal %s: %s", j.path, err)
+	}
+	return nil
+}
+
+// rotate moves the journal file to a segment named after its last entry and
+// opens a new empty journal file. Without segments to keep the journal file
+// is emptied instead.
+func (j *taskJournal) rotate() error {
+	if config.JournalKeepSegments <= 0 {
+		if err := j.file.Truncate(0); err != nil {
+			return err
+		}
+		return j.file.Sync()
+	}
+
+	segment := fmt.Sprintf("%s.journal.%d", j.path, j.seq)
+	if err := os.Rename(j.path+".journal", segment); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path+".journal", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		err = syncDir(filepath.Dir(j.path))
+	}
+	if err != nil {
+		// Entries written to the open file must end up in the journal
+		if f != nil {
+			f.Close()
+		}
+		os.Rename(segment, j.path+".journal")
+		return err
+	}
+
+	j.file.Close()
+	j.file = f
+	return nil
+}
+
+// journalSegments lists the sequence numbers of the segments of the journal,
+// oldest first
+func journalSegments(path string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(path) + ".journal."
+	segments := []uint64{}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), prefix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimPrefix(f.Name(), prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+
+	sort.Slice(segments, func(i, k int) bool { return segments[i] < segments[k] })
+	return segments, nil
+}
+
+// pruneJournalSegments removes all but the newest keep segments of the journal
+func pruneJournalSegments(path string, keep int) error {
+	segments, err := journalSegments(path)
+	if err != nil {
+		return err
+	}
+
+	for len(segments) > keep && len(segments) > 0 {
+		if err := removeIfExists(fmt.Sprintf("%s.journal.%d", path, segments[0])); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+func (j *taskJournal) close() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.file.Close()
+}
+
+// splitStoreDocument separates the tasks of a store document from its other
+// fields, the header is marshalled with sorted keys so it can be compared
+func splitStoreDocument(data []byte) (json.RawMessage, []string, map[string]json.RawMessage, error) {
+	doc := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, nil, err
+	}
+
+	list := []json.RawMessage{}
+	if raw, ok := doc["Tasks"]; ok {
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, nil, nil, err
+		}
+		delete(doc, "Tasks")
+	}
+
+	header, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	order := []string{}
+	tasks := map[string]json.RawMessage{}
+	for _, raw := range list {
+		t := struct{ ID string }{}
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return nil, nil, nil, err
+		}
+		if t.ID == "" {
+			return nil, nil, nil, fmt.Errorf("Task without ID")
+		}
+		if _, ok := tasks[t.ID]; !ok {
+			order = append(order, t.ID)
+		}
+		tasks[t.ID] = raw
+	}
+
+	return header, order, tasks, nil
+}
+
+// writeFileAtomic replaces the file with data so it either contains the old
+// or the new data after a crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes renames and newly created files in the directory durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const journalTestKey = "habitrpg-tasks"
+
+var (
+	// First save: header and one task, two entries in one batch
+	journalDocFirst = `{"SchemaVersion":2,"Tasks":[{"ID":"a","Title":"First"}]}`
+	// Second save: three changed tasks in one batch
+	journalDocSecond = `{"SchemaVersion":2,"Tasks":[{"ID":"a","Title":"Changed"},{"ID":"b","Title":"Second"},{"ID":"c","Title":"Third"}]}`
+	// Save after reopening
+	journalDocThird = `{"SchemaVersion":2,"Tasks":[{"ID":"b","Title":"Second"},{"ID":"c","Title":"Third"}]}`
+)
+
+func withJournalConfig(t *testing.T, compactEntries, keepSegments int) {
+	withConfig(t, func(c *configuration) {
+		c.JournalCompactEntries = compactEntries
+		c.JournalKeepSegments = keepSegments
+	})
+}
+
+func openTestJournal(t *testing.T, dir string) *journalStorage {
+	t.Helper()
+
+	s, err := openJournalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func saveTestDocuments(t *testing.T, s *journalStorage, docs ...string) {
+	t.Helper()
+
+	for _, doc := range docs {
+		if err := s.Set(journalTestKey, []byte(doc)); err != nil {
+			t.Fatalf("Save failed: %s", err)
+		}
+	}
+}
+
+func expectTestDocument(t *testing.T, s *journalStorage, expected string) {
+	t.Helper()
+
+	doc, err := s.Get(journalTestKey)
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	if (expected == "" && doc != nil) || (expected != "" && string(doc) != expected) {
+		t.Errorf("Unexpected document:\n got: %s\nwant: %s", doc, expected)
+	}
+}
+
+// journalLines returns the lines of the journal file including their line
+// breaks
+func journalLines(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+func TestJournalReplayTornTail(t *testing.T) {
+	withJournalConfig(t, 1000, 0)
+
+	dir := t.TempDir()
+	s := openTestJournal(t, dir)
+	saveTestDocuments(t, s, journalDocFirst, journalDocSecond)
+	s.Close()
+
+	journal := filepath.Join(dir, journalTestKey+".journal")
+	data, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := journalLines(t, journal)
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 journal lines, got %d", len(lines))
+	}
+	firstBatch := len(lines[0]) + len(lines[1])
+
+	for name, c := range map[string]struct {
+		cut      int
+		expected string
+		size     int
+	}{
+		"complete":                   {len(data), journalDocSecond, len(data)},
+		"missing line break":         {len(data) - 1, journalDocFirst, firstBatch},
+		"mid-line in last batch":     {len(data) - 20, journalDocFirst, firstBatch},
+		"mid-batch at line boundary": {firstBatch + len(lines[2]), journalDocFirst, firstBatch},
+		"mid-line in first batch":    {len(lines[0]) / 2, "", 0},
+		"first batch without commit": {len(lines[0]), "", 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			journal := filepath.Join(dir, journalTestKey+".journal")
+			if err := ioutil.WriteFile(journal, data[:c.cut], 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			s := openTestJournal(t, dir)
+			expectTestDocument(t, s, c.expected)
+
+			if fi, err := os.Stat(journal); err != nil || fi.Size() != int64(c.size) {
+				t.Errorf("Journal was not truncated to %d bytes: %v %v", c.size, fi.Size(), err)
+			}
+
+			// Saves after the recovery are appended to the committed batches
+			saveTestDocuments(t, s, journalDocThird)
+			s.Close()
+
+			expectTestDocument(t, openTestJournal(t, dir), journalDocThird)
+		})
+	}
+}
+
+func TestJournalReplayDamaged(t *testing.T) {
+	withJournalConfig(t, 1000, 0)
+
+	dir := t.TempDir()
+	s := openTestJournal(t, dir)
+	saveTestDocuments(t, s, journalDocFirst, journalDocSecond)
+	s.Close()
+
+	// Damage in front of committed entries is not a torn write
+	journal := filepath.Join(dir, journalTestKey+".journal")
+	lines := journalLines(t, journal)
+	lines[1] = bytes.Replace(lines[1], []byte("First"), []byte("Fir5t"), 1)
+	if err := ioutil.WriteFile(journal, bytes.Join(lines, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := openTestJournal(t, dir).Get(journalTestKey)
+	if err == nil || !strings.Contains(err.Error(), "Journal is damaged") {
+		t.Errorf("Expected damaged journal error, got %v", err)
+	}
+}
+
+func TestJournalCompactKeepsSegments(t *testing.T) {
+	withJournalConfig(t, 2, 2)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, journalTestKey)
+	s := openTestJournal(t, dir)
+
+	// Every save changes one task, the first one also writes the header
+	docs := []string{}
+	for _, title := range []string{"1", "2", "3", "4", "5"} {
+		docs = append(docs, `{"SchemaVersion":2,"Tasks":[{"ID":"a","Title":"`+title+`"}]}`)
+	}
+	saveTestDocuments(t, s, docs...)
+
+	segments, err := journalSegments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(segments, []uint64{4, 6}) {
+		t.Fatalf("Expected segments 4 and 6, got %v", segments)
+	}
+
+	// The newest segment holds the entries compacted last
+	seqs := []uint64{}
+	for _, line := range journalLines(t, path+".journal.6") {
+		e, err := parseJournalLine(bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			t.Fatalf("Segment is damaged: %s", err)
+		}
+		seqs = append(seqs, e.Seq)
+	}
+	if !reflect.DeepEqual(seqs, []uint64{5, 6}) {
+		t.Errorf("Expected entries 5 and 6 in segment, got %v", seqs)
+	}
+
+	if fi, err := os.Stat(path + ".journal"); err != nil || fi.Size() != 0 {
+		t.Errorf("Journal was not started over after compaction: %v", err)
+	}
+
+	s.Close()
+	s = openTestJournal(t, dir)
+	expectTestDocument(t, s, docs[len(docs)-1])
+
+	// Without segments to keep the journal is emptied and old ones removed
+	withConfig(t, func(c *configuration) { c.JournalKeepSegments = 0 })
+	saveTestDocuments(t, s, docs[0], docs[1])
+	if segments, err := journalSegments(path); err != nil || len(segments) != 0 {
+		t.Errorf("Segments were not removed: %v %v", segments, err)
+	}
+
+	saveTestDocuments(t, s, docs[2])
+	withConfig(t, func(c *configuration) { c.JournalKeepSegments = 2 })
+	saveTestDocuments(t, s, docs[3])
+	if err := s.Del(journalTestKey); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Files left after deleting the journal: %d", len(files))
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/xuyu/goredis"
+)
+
+// Only one replica may run the scheduling jobs and write to Redis at a time.
+// The replicas compete for a lease stored in Redis, the lease value contains
+// the instance ID and a fencing token incremented on every acquisition. All
+// writes are executed by scripts checking the lease value so an instance
+// which lost its lease (for example after a long pause) can not overwrite
+// the data of its successor.
+
+const (
+	// acquireLeaseScript takes the lease if it is free or extends it if it is
+	// held with the value given in ARGV[3]. It returns the current lease value.
+	acquireLeaseScript = `
+local cur = redis.call("GET", KEYS[1])
+if not cur then
+	cur = ARGV[1] .. ":" .. redis.call("INCR", KEYS[2])
+	redis.call("SET", KEYS[1], cur, "PX", ARGV[2])
+elseif cur == ARGV[3] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return cur`
+
+	releaseLeaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+	fencedSetScript = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[2])
+return 1`
+
+	fencedDelScript = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[2])
+return 1`
+)
+
+var errNotLeader = fmt.Errorf("This instance is not the leader")
+
+// leadership is nil if leader election is disabled, the instance then
+// always acts as leader
+var leadership *leaderElector
+
+type leaderElector struct {
+	instanceID string
+	leaseTime  time.Duration
+
+	lock      sync.RWMutex
+	held      string // Lease value while this instance is the leader
+	holder    string // Lease value seen on the last attempt
+	lastRenew time.Time
+
+	tickLock sync.Mutex
+	stopped  bool
+}
+
+func newLeaderElector() *leaderElector {
+	id := config.InstanceID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = host + "-" + uuid.NewV4().String()[:8]
+	}
+
+	return &leaderElector{
+		instanceID: id,
+		leaseTime:  config.LeaderLease,
+	}
+}
+
+func leaseKey() string {
+	return config.RedisStoreKey + ":leader"
+}
+
+func fencingKey() string {
+	return config.RedisStoreKey + ":leader:fence"
+}
+
+// isLeader reports whether this instance may run the scheduling jobs and
+// modify the stored data
+func isLeader() bool {
+	if leadership == nil {
+		return true
+	}
+	return leadership.fence() != ""
+}
+
+func (l *leaderElector) fence() string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.held
+}
+
+// Leader returns the instance ID of the current leader as seen on the last
+// attempt to acquire the lease
+func (l *leaderElector) Leader() string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	if i := strings.LastIndex(l.holder, ":"); i >= 0 {
+		return l.holder[:i]
+	}
+	return l.holder
+}
+
+// run tries to acquire or renew the lease three times per lease time until
+// Stop is called. Followers reload the state written by the leader on every
+// attempt.
+func (l *leaderElector) run() {
+	for {
+		if !l.tick() {
+			return
+		}
+		time.Sleep(l.leaseTime / 3)
+	}
+}
+
+func (l *leaderElector) tick() bool {
+	l.tickLock.Lock()
+	defer l.tickLock.Unlock()
+
+	if l.stopped {
+		return false
+	}
+
+	held := l.fence()
+
+	rp, err := redisConnection.Eval(acquireLeaseScript,
+		[]string{leaseKey(), fencingKey()},
+		[]string{l.instanceID, fmt.Sprintf("%d", l.leaseTime.Milliseconds()), held})
+	var cur string
+	if err == nil {
+		cur, err = rp.StringValue()
+	}
+
+	if err != nil {
+		log.Printf("Unable to renew leader lease: %s", err)
+		l.lock.Lock()
+		if l.held != "" && time.Since(l.lastRenew) > l.leaseTime {
+			// The lease has expired in Redis by now, someone else might take over
+			log.Printf("Lost leadership: lease could not be renewed for %s", l.leaseTime)
+			l.held = ""
+		}
+		l.lock.Unlock()
+		return true
+	}
+
+	switch {
+	case cur == held:
+		l.lock.Lock()
+		l.lastRenew = time.Now()
+		l.holder = cur
+		l.lock.Unlock()
+
+	case strings.HasPrefix(cur, l.instanceID+":"):
+		// Another instance might have written in the meantime, start from
+		// the stored state before taking over
+		if err := accounts.Reload(); err != nil {
+			log.Printf("Unable to reload state before taking over leadership: %s", err)
+			l.release(cur)
+			return true
+		}
+
+		l.lock.Lock()
+		l.held, l.holder, l.lastRenew = cur, cur, time.Now()
+		l.lock.Unlock()
+		log.Printf("Acquired leadership as %s", cur)
+		resyncScheduler()
+
+	default:
+		l.lock.Lock()
+		if l.held != "" {
+			log.Printf("Lost leadership to %s", cur)
+		}
+		l.held, l.holder = "", cur
+		l.lock.Unlock()
+
+		if err := accounts.Reload(); err != nil {
+			log.Printf("Unable to reload state written by leader: %s", err)
+		}
+	}
+
+	return true
+}
+
+// Stop ends the election and gives up the lease so another instance can take
+// over right away
+func (l *leaderElector) Stop() {
+	l.tickLock.Lock()
+	l.stopped = true
+	l.tickLock.Unlock()
+
+	l.lock.Lock()
+	held := l.held
+	l.held = ""
+	l.lock.Unlock()
+
+	if held != "" {
+		l.release(held)
+	}
+}
+
+func (l *leaderElector) release(value string) {
+	if _, err := redisConnection.Eval(releaseLeaseScript, []string{leaseKey()}, []string{value}); err != nil {
+		log.Printf("Unable to release leader lease: %s", err)
+	}
+}
+
+// redisSet writes the value to Redis. With leader election enabled the write
+// is only executed while this instance holds the lease.
+func redisSet(conn *goredis.Redis, key, value string) error {
+	if leadership == nil {
+		return conn.Set(key, value, 0, 0, false, false)
+	}
+	return fencedWrite(conn, fencedSetScript, key, value)
+}
+
+// redisDel deletes the key, fenced like redisSet
+func redisDel(conn *goredis.Redis, key string) error {
+	if leadership == nil {
+		_, err := conn.Del(key)
+		return err
+	}
+	return fencedWrite(conn, fencedDelScript, key)
+}
+
+func fencedWrite(conn *goredis.Redis, script, key string, args ...string) error {
+	fence := leadership.fence()
+	if fence == "" {
+		return errNotLeader
+	}
+
+	rp, err := conn.Eval(script, []string{leaseKey(), key}, append([]string{fence}, args...))
+	if err != nil {
+		return err
+	}
+
+	ok, err := rp.IntegerValue()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return errNotLeader
+	}
+	return nil
+}
+
+// isWriteRequest reports whether the request modifies the stored data
+func isWriteRequest(r *http.Request) bool {
+	return r.Method != "GET" && r.Method != "HEAD" && r.URL.Path != "/v1/schedule/preview"
+}
+
+// requireLeader rejects modifying requests on followers, they only serve
+// the state written by the leader
+func requireLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if isWriteRequest(r) && !isLeader() {
+			res.Header().Set("Retry-After", "5")
+			http.Error(res, fmt.Sprintf("This instance is not the leader, changes have to be sent to %s", leadership.Leader()), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(res, r)
+	})
+}
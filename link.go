@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+)
+
+// todoLink is read from create and update requests to adopt an existing
+// HabitRPG todo as the open occurrence of the task instead of creating a new
+// one. The todo is either given by its ID or alias in LinkTodo or searched by
+// its text in LinkTodoText which needs ConfirmLink to be set once the match
+// was shown to the user.
+type todoLink struct {
+	LinkTodo     string
+	LinkTodoText string
+	ConfirmLink  bool
+}
+
+// linkError is returned when the todo to link could not be determined from
+// the request, Status is the HTTP status to respond with
+type linkError struct {
+	Status  int
+	Message string
+}
+
+func (l linkError) Error() string { return l.Message }
+
+func parseTodoLink(input []byte) (todoLink, error) {
+	link := todoLink{}
+	if err := json.Unmarshal(input, &link); err != nil {
+		return link, fmt.Errorf("Could not deserialize JSON: %s", err)
+	}
+
+	link.LinkTodo = strings.TrimSpace(link.LinkTodo)
+	link.LinkTodoText = strings.TrimSpace(link.LinkTodoText)
+
+	if link.LinkTodo != "" && link.LinkTodoText != "" {
+		return link, fmt.Errorf("Only one of LinkTodo or LinkTodoText may be given")
+	}
+
+	return link, nil
+}
+
+func (l todoLink) requested() bool {
+	return l.LinkTodo != "" || l.LinkTodoText != ""
+}
+
+// resolveTodoLink looks up the todo to link in HabitRPG and verifies it is
+// an open todo
+func (h *HabitTaskStore) resolveTodoLink(link todoLink) (*habitrpg.Task, error) {
+	if link.LinkTodo != "" {
+		todo, err := h.fetchTodo(link.LinkTodo)
+		switch {
+		case err == errTodoNotFound:
+			return nil, linkError{http.StatusBadRequest, fmt.Sprintf("HabitRPG has no task %q", link.LinkTodo)}
+		case err != nil:
+			return nil, fmt.Errorf("Unable to fetch task from HabitRPG: %s", err)
+		case todo.Type != "todo":
+			return nil, linkError{http.StatusBadRequest, fmt.Sprintf("HabitRPG task %q is a %s, only todos can be linked", link.LinkTodo, todo.Type)}
+		case todo.Completed:
+			return nil, linkError{http.StatusBadRequest, fmt.Sprintf("HabitRPG todo %q is already completed", link.LinkTodo)}
+		}
+
+		return todo, nil
+	}
+
+	res := struct {
+		Data []habitrpg.Task `json:"data"`
+	}{}
+	if err := h.doHTTPRequest("GET", "application/json", "/tasks/user?type=todos", nil, &res); err != nil {
+		return nil, fmt.Errorf("Unable to fetch todos from HabitRPG: %s", err)
+	}
+
+	matches := []habitrpg.Task{}
+	for _, t := range res.Data {
+		if t.Type == "todo" && !t.Completed && strings.EqualFold(strings.TrimSpace(t.Text), link.LinkTodoText) {
+			matches = append(matches, t)
+		}
+	}
+
+	switch {
+	case len(matches) == 0:
+		return nil, linkError{http.StatusBadRequest, fmt.Sprintf("Found no open todo with text %q", link.LinkTodoText)}
+
+	case len(matches) > 1:
+		ids := []string{}
+		for _, t := range matches {
+			ids = append(ids, t.ID)
+		}
+		return nil, linkError{http.StatusBadRequest, fmt.Sprintf("Found %d open todos with text %q, link one of them by ID: %s",
+			len(matches), link.LinkTodoText, strings.Join(ids, ", "))}
+
+	case !link.ConfirmLink:
+		return nil, linkError{http.StatusConflict, fmt.Sprintf("Found open todo %q (%s) created %s, set ConfirmLink to link it",
+			matches[0].Text, matches[0].ID, matches[0].DateCreated.Format("2006-01-02 15:04"))}
+	}
+
+	return &matches[0], nil
+}
+
+// linkedTask returns the ID of the task in the store having the todo as its
+// open occurrence. The store must be locked by the caller.
+func (h *HabitTaskStore) linkedTask(todoID string) string {
+	for _, t := range h.Tasks {
+		if t.LastTaskID == todoID && !t.IsCompleted {
+			return t.ID
+		}
+	}
+	return ""
+}
+
+// adoptTodo makes the todo the open occurrence of the task
+func (t *HabitTask) adoptTodo(todo *habitrpg.Task) {
+	t.LastTaskID = todo.ID
+	t.OverdueReported = false
+	t.IsCompleted = false
+	if !todo.DateCreated.IsZero() {
+		t.NextEntryDate = todo.DateCreated
+	}
+}
+
+// linkTodo makes the todo the open occurrence of an existing task. A todo
+// still open for the task is replaced and deleted in HabitRPG together with
+// the operations queued for it. Tasks whose todo is being created can not be
+// linked as the created todo would not be tracked. The store must be locked
+// by the caller.
+func (h *HabitTaskStore) linkTodo(task *HabitTask, todo *habitrpg.Task) error {
+	if task.PendingCreate != "" {
+		return linkError{http.StatusConflict, "The todo of the task is being created, link the todo once it was created"}
+	}
+
+	if task.LastTaskID != "" && task.LastTaskID != todo.ID && !task.IsCompleted {
+		h.dropOperations(task.ID)
+		h.enqueue(OutboxOperation{Kind: outboxDelete, TaskID: task.ID, TodoID: task.LastTaskID})
+	}
+
+	task.adoptTodo(todo)
+	return nil
+}
+
+func writeLinkError(res http.ResponseWriter, err error) {
+	var le linkError
+	if errors.As(err, &le) {
+		http.Error(res, le.Message, le.Status)
+		return
+	}
+	http.Error(res, err.Error(), http.StatusBadGateway)
+}
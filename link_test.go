@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func dueTestTask(id, title string) HabitTask {
+	return HabitTask{
+		ID:            id,
+		Title:         title,
+		RepeatHours:   24,
+		IsCompleted:   true,
+		NextEntryDate: time.Now().Add(-time.Hour),
+		OnDelete:      onDeleteSkip,
+	}
+}
+
+func TestLinkTodoWhileCreatePending(t *testing.T) {
+	f := newFakeHabitica(t)
+	store := newTestStore(t, f, t.TempDir())
+	store.Tasks = []HabitTask{dueTestTask("a", "Water plants")}
+
+	// HabitRPG fails so the creation stays queued
+	f.fail = http.StatusServiceUnavailable
+	if _, err := store.createDueTasks(nil); err == nil {
+		t.Fatal("Creating the todo did not fail")
+	}
+	f.fail = 0
+
+	existing := f.addTodo("Water the plants")
+
+	store.lock.Lock()
+	err := store.linkTodo(store.task("a"), existing)
+	task := *store.task("a")
+	outboxSize := len(store.Outbox)
+	store.lock.Unlock()
+
+	var le linkError
+	if !errors.As(err, &le) || le.Status != http.StatusConflict {
+		t.Fatalf("Expected conflict while the todo is created, got %v", err)
+	}
+	if task.PendingCreate == "" || task.LastTaskID != "" || outboxSize != 1 {
+		t.Errorf("Refused link changed the task or outbox: %+v, %d operations", task, outboxSize)
+	}
+
+	// The queued creation is still tracked once executed
+	if err := store.processOutbox(true); err != nil {
+		t.Fatal(err)
+	}
+	store.lock.RLock()
+	task = *store.task("a")
+	store.lock.RUnlock()
+	if task.PendingCreate != "" || task.LastTaskID == "" || task.LastTaskID == existing.ID {
+		t.Errorf("Created todo is not tracked: %+v", task)
+	}
+}
+
+func TestLinkTodoReplacesOpenTodo(t *testing.T) {
+	f := newFakeHabitica(t)
+	store := newTestStore(t, f, t.TempDir())
+	store.Tasks = []HabitTask{dueTestTask("a", "Water plants")}
+
+	if _, err := store.createDueTasks(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := f.addTodo("Water the plants")
+
+	store.lock.Lock()
+	task := store.task("a")
+	previous := task.LastTaskID
+	// Not executed yet when the link replaces the todo
+	store.enqueue(OutboxOperation{Kind: outboxUpdate, TaskID: "a", TodoID: previous, Text: "Water all plants"})
+	err := store.linkTodo(task, existing)
+	ops := append([]OutboxOperation{}, store.Outbox...)
+	store.lock.Unlock()
+
+	if err != nil {
+		t.Fatalf("Link failed: %s", err)
+	}
+	if len(ops) != 1 || ops[0].Kind != outboxDelete || ops[0].TodoID != previous {
+		t.Fatalf("Expected only the deletion of the previous todo to be queued, got %+v", ops)
+	}
+
+	if err := store.processOutbox(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := f.openTodos(); !reflect.DeepEqual(got, []string{"Water the plants"}) {
+		t.Errorf("Unexpected open todos in HabitRPG: %v", got)
+	}
+
+	store.lock.RLock()
+	linked := *store.task("a")
+	store.lock.RUnlock()
+	if linked.LastTaskID != existing.ID || linked.IsCompleted || len(store.Outbox) != 0 {
+		t.Errorf("Task is not linked to the todo: %+v", linked)
+	}
+}
@@ -1,92 +1,352 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/Luzifer/habitscheduler/habitrpg"
 	"github.com/Luzifer/rconfig"
 	"github.com/gorilla/mux"
 	"github.com/robfig/cron"
 	"github.com/xuyu/goredis"
 )
 
-var (
-	config struct {
-		RedisAddress  string `flag:"redis-url" default:"" description:"Connectionstring to redis server"`
-		RedisStoreKey string `flag:"redis-key" default:"habitrpg-tasks" description:"Key to store the data in"`
+// configuration holds the command line flags parsed into config
+type configuration struct {
+	RedisAddress  string `flag:"redis-url" default:"" description:"Connectionstring to redis server"`
+	RedisStoreKey string `flag:"redis-key" default:"habitrpg-tasks" description:"Key to store the data in (file name prefix for journal storage)"`
 
-		ListenAddress string `flag:"listen" default:":3000" description:"Address incl. port to have the API listen on"`
+	Storage               string `flag:"storage" default:"redis" description:"Where to store the data: redis / journal"`
+	JournalDir            string `flag:"journal-dir" default:"data" description:"Directory holding the files of the journal storage"`
+	JournalCompactEntries int    `flag:"journal-compact-entries" default:"1000" description:"Compact a task journal into a snapshot after this many entries"`
+	JournalKeepSegments   int    `flag:"journal-keep-segments" default:"10" description:"Number of compacted journal segments to keep as change history (0 to keep none)"`
 
-		HabitRPGUserID   string `flag:"habit-user" default:"" description:"User-ID from API page in HabitRPG"`
-		HabitRPGAPIToken string `flag:"habit-token" default:"" description:"API-Token for that HabitRPG user"`
+	ListenAddress string `flag:"listen" default:":3000" description:"Address incl. port to have the API listen on"`
+
+	APITokens    []string `flag:"api-token" default:"" description:"Bearer tokens allowed to use the API in format token[:read|write|admin[:account]] (tasks API is open and admin requests are refused if no token is set)"`
+	APITokenFile string   `flag:"api-token-file" default:"" description:"File containing one API token in format token[:read|write|admin[:account]] per line"`
+	CORSOrigins  []string `flag:"cors-origin" default:"" description:"Origins allowed to access the API from a browser (* to allow all)"`
+
+	HabitRPGUserID   string `flag:"habit-user" default:"" description:"User-ID from API page in HabitRPG for the default account"`
+	HabitRPGAPIToken string `flag:"habit-token" default:"" description:"API-Token for that HabitRPG user"`
+
+	MasterKey          string   `flag:"master-key" default:"" description:"Random string of at least 32 characters to encrypt stored HabitRPG API tokens with (e.g. openssl rand -base64 32)"`
+	MasterKeyFile      string   `flag:"master-key-file" default:"" description:"File containing the master key to encrypt stored HabitRPG API tokens with"`
+	PreviousMasterKeys []string `flag:"previous-master-key" default:"" description:"Former master keys still accepted to decrypt tokens (stored tokens are re-encrypted with the current key on start)"`
+
+	CronCreateTask  string `flag:"cron-create" default:"0 */15 * * * *" description:"Cron entry for the safety sweep creating tasks missed by the scheduler"`
+	CronSaveToRedis string `flag:"cron-persist" default:"0 * * * * *" description:"Cron entry for saving all data to Redis in addition to saving every change right away"`
+	CronUpdateTasks string `flag:"cron-update" default:"10 */5 * * * *" description:"Cron entry for fetchin task updates from HabitRPG"`
+
+	ImportMode     string `flag:"import-mode" default:"merge" description:"How to apply an import: merge / replace"`
+	ImportConflict string `flag:"import-conflict" default:"skip" description:"What to do with imported tasks having an existing ID: skip / overwrite / new-id"`
+
+	Server string `flag:"server" default:"http://127.0.0.1:3000" description:"Base URL of the running server used by the tasks, export and import commands"`
+	Token  string `flag:"token" default:"" description:"API token sent by the tasks, export and import commands"`
+	Output string `flag:"output,o" default:"table" description:"Output format of the tasks commands: table / json"`
+
+	PersistRetryTimeout  time.Duration `flag:"persist-retry-timeout" default:"45s" description:"How long to retry a failed save to Redis before waiting for the next --cron-persist run"`
+	PersistDebounce      time.Duration `flag:"persist-debounce" default:"100ms" description:"How long to collect changes before saving them to Redis together"`
+	PersistAlertAfter    time.Duration `flag:"persist-alert-after" default:"5m" description:"Report not ready and log an alert if saving to Redis failed for this long"`
+	ShutdownTimeout      time.Duration `flag:"shutdown-timeout" default:"30s" description:"How long to wait for running requests and jobs on shutdown"`
+	ReadyUpdateThreshold time.Duration `flag:"ready-update-threshold" default:"30m" description:"Report not ready if fetching task updates from HabitRPG did not succeed for this long"`
+
+	HabitBreakerFailures int           `flag:"habit-breaker-failures" default:"5" description:"Stop sending requests to HabitRPG after this many failures in a row"`
+	HabitBreakerOpen     time.Duration `flag:"habit-breaker-open" default:"30s" description:"How often to check whether HabitRPG is available again after it failed"`
+
+	OverdueAfter time.Duration `flag:"overdue-after" default:"24h" description:"Consider an occurrence overdue once its todo is open for this long, unless the task sets OverdueHours (0 to disable)"`
+
+	Webhooks       []string      `flag:"webhook" default:"" description:"URL to POST events to, optionally followed by #type|type... to only send these event types (e.g. #task.*|occurrence.created)"`
+	WebhookSecret  string        `flag:"webhook-secret" default:"" description:"Secret to sign webhook payloads with (HMAC-SHA256)"`
+	WebhookRetries int           `flag:"webhook-retries" default:"5" description:"How often to retry a failed webhook delivery"`
+	WebhookTimeout time.Duration `flag:"webhook-timeout" default:"10s" description:"Timeout of a single webhook delivery attempt"`
+	WebhookLogSize int           `flag:"webhook-log-size" default:"500" description:"Number of webhook deliveries kept in the delivery log"`
+
+	SMTPHost              string        `flag:"smtp-host" default:"" description:"SMTP server (host:port) to send email notifications through (disabled if empty)"`
+	SMTPUsername          string        `flag:"smtp-username" default:"" description:"User to authenticate at the SMTP server with"`
+	SMTPPassword          string        `flag:"smtp-password" default:"" description:"Password to authenticate at the SMTP server with"`
+	SMTPStartTLS          string        `flag:"smtp-starttls" default:"auto" description:"When to use STARTTLS: auto / require / off"`
+	SMTPFrom              string        `flag:"smtp-from" default:"habitscheduler@localhost" description:"Sender address of email notifications"`
+	EmailDigest           time.Duration `flag:"email-digest" default:"0" description:"Bundle the email notifications of each recipient and send them at this interval (0 to send right away)"`
+	EmailSubjectTemplate  string        `flag:"email-subject-template" default:"" description:"Go template for the subject of email notifications (default: built-in)"`
+	EmailBodyTemplateFile string        `flag:"email-body-template-file" default:"" description:"File containing the Go template for the body of email notifications (default: built-in)"`
+
+	MQTTURL          string   `flag:"mqtt-url" default:"" description:"MQTT broker to publish events to and receive commands from: tcp://[user:pass@]host:port or mqtts://... (disabled if empty)"`
+	MQTTClientID     string   `flag:"mqtt-client-id" default:"" description:"Client ID used at the MQTT broker (default: habitscheduler- and the instance ID)"`
+	MQTTEventTopic   string   `flag:"mqtt-event-topic" default:"habitscheduler/{account}/events/{type}" description:"Topic to publish events to, {account}, {type} and {task} are replaced (empty to not publish events)"`
+	MQTTEvents       []string `flag:"mqtt-events" default:"" description:"Event types to publish to MQTT, a type ending in .* matches all types with that prefix (default: all)"`
+	MQTTQoS          int      `flag:"mqtt-qos" default:"1" description:"QoS of the events published to MQTT: 0 / 1"`
+	MQTTCommandTopic string   `flag:"mqtt-command-topic" default:"habitscheduler/{account}/command" description:"Topic to receive commands on, {account} matches all accounts (empty to not receive commands)"`
+
+	EventBufferSize int `flag:"event-buffer-size" default:"1000" description:"Number of events kept for clients resuming the event stream"`
+
+	SyncFetchIndividually int `flag:"sync-fetch-individually" default:"5" description:"Fetch open todos from HabitRPG one by one instead of listing all todos if there are at most this many"`
+
+	LeaderElection bool          `flag:"leader-election" default:"false" description:"Elect a leader using a lease in Redis to run multiple replicas with the same --redis-key"`
+	LeaderLease    time.Duration `flag:"leader-lease" default:"15s" description:"How long the leader lease is valid without being renewed"`
+	InstanceID     string        `flag:"instance-id" default:"" description:"Name of this replica used for leader election (default: hostname and random suffix)"`
+}
+
+var (
+	config configuration
 
-		CronCreateTask  string `flag:"cron-create" default:"0 * * * * *" description:"Cron entry for creating new tasks"`
-		CronSaveToRedis string `flag:"cron-persist" default:"0 * * * * *" description:"Cron entry for saving data to Redis"`
-		CronUpdateTasks string `flag:"cron-update" default:"10 */5 * * * *" description:"Cron entry for fetchin task updates from HabitRPG"`
-	}
 	redisConnection *goredis.Redis
-	habitRPG        *HabitTaskStore
+	accounts        *AccountRegistry
+
+	version   = "dev"
+	startedAt = time.Now()
 )
 
 func init() {
-	var err error
 	rconfig.Parse(&config)
+}
 
-	redisConnection, err = goredis.DialURL(config.RedisAddress)
-	if err != nil {
-		log.Printf("Error while connecting to Redis: %s", err)
+// initStore opens the storage and loads all accounts, used by commands
+// which can not do anything useful without the stored data
+func initStore() {
+	if err := loadCredentialCipher(); err != nil {
+		log.Printf("Error while loading master key: %s", err)
 		os.Exit(1)
 	}
 
-	habitRPG = NewHabitTaskStore(redisConnection)
-	err = habitRPG.Load()
-	if err != nil {
+	if err := openStore(); err != nil {
 		log.Printf("Error while loading HabitRPG store: %s", err)
 		os.Exit(1)
 	}
+	storeReady.Store(true)
+}
+
+func openStore() error {
+	st, err := openStorage()
+	if err != nil {
+		return err
+	}
+
+	registry := NewAccountRegistry(st)
+	if err := registry.Load(); err != nil {
+		st.Close()
+		return err
+	}
+
+	if rs, ok := st.(redisStorage); ok {
+		redisConnection = rs.conn
+	}
+	dataStorage = st
+	accounts = registry
+	return nil
 }
 
 func main() {
+	args := rconfig.Args()[1:]
+	if len(args) == 0 {
+		serve()
+		return
+	}
+
+	switch args[0] {
+	case "serve":
+		serve()
+	case "export":
+		cliExport(args[1:])
+	case "import":
+		cliImport(args[1:])
+	case "rotate-key":
+		// Loading the accounts re-encrypts all tokens with the current key
+		initStore()
+		log.Printf("All stored HabitRPG API tokens are encrypted with the current master key")
+	case "tasks":
+		cliTasks(args[1:])
+	case "help":
+		cliUsage()
+	default:
+		log.Printf("Unknown command: %s", args[0])
+		cliUsage()
+	}
+}
+
+func serve() {
+	if err := loadAPITokens(); err != nil {
+		log.Printf("Error while loading API tokens: %s", err)
+		os.Exit(1)
+	}
+
+	if err := loadCredentialCipher(); err != nil {
+		log.Printf("Error while loading master key: %s", err)
+		os.Exit(1)
+	}
+
+	if config.LeaderElection && config.Storage != storageRedis {
+		log.Printf("Leader election needs --storage=%s", storageRedis)
+		os.Exit(1)
+	}
+
+	if config.LeaderElection {
+		leadership = newLeaderElector()
+		log.Printf("Leader election enabled, instance ID is %s", leadership.instanceID)
+	}
+
+	habiticaBreaker = newHabiticaBreaker()
+
+	hooks, err := newWebhookDispatcher()
+	if err != nil {
+		log.Printf("Error while loading webhooks: %s", err)
+		os.Exit(1)
+	}
+	if hooks != nil {
+		webhooks = hooks
+		events.Subscribe(webhooks.handleEvent)
+		webhooks.run()
+		log.Printf("Sending events to %d webhook(s)", len(webhooks.hooks))
+	}
+
+	events.Subscribe(stream.handleEvent)
+
+	m, err := newEmailMailer()
+	if err != nil {
+		log.Printf("Error while setting up email notifications: %s", err)
+		os.Exit(1)
+	}
+	if m != nil {
+		mailer = m
+		events.Subscribe(mailer.handleEvent)
+		go mailer.run()
+	}
+
+	mc, err := newMQTTClient()
+	if err != nil {
+		log.Printf("Error while setting up MQTT: %s", err)
+		os.Exit(1)
+	}
+	if mc != nil {
+		mqttClient = mc
+		if config.MQTTEventTopic != "" {
+			events.Subscribe(publishMQTTEvent)
+		}
+		mqttClient.Start()
+	}
+
+	jobs := &jobRunner{}
+
+	scheduler = newDueScheduler()
+	go scheduler.run(jobs)
+	go writer.run()
+	go outbox.run(jobs)
+
+	// The API is served while the store is still connecting, requests
+	// needing it are rejected and readiness is reported as failing
+	go func() {
+		connectStore()
+		if leadership != nil {
+			leadership.run()
+		}
+	}()
+
 	c := cron.New()
-	c.AddFunc(config.CronSaveToRedis, func() {
-		err := habitRPG.Save()
-		if err == nil {
+	// All jobs need the store and are skipped until it is loaded and on
+	// instances not being the leader
+	c.AddFunc(config.CronSaveToRedis, jobs.wrap(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), config.PersistRetryTimeout)
+		defer cancel()
+
+		if err := saveWithRetry(ctx); err == nil {
 			log.Println("Save to Redis: Success")
 		} else {
-			log.Printf("Save to Redis: %s\n", err)
-			os.Exit(1)
+			log.Printf("Save to Redis: %s, keeping state in memory until next try\n", err)
 		}
-	})
-	c.AddFunc(config.CronCreateTask, func() {
-		if err := habitRPG.CreateDueTasks(); err != nil {
-			log.Printf("An error ocurred while creating tasks: %s", err)
+	}))
+	c.AddFunc(config.CronCreateTask, jobs.wrap(func() {
+		for _, store := range accounts.Stores() {
+			if !store.hasCredentials() {
+				continue
+			}
+			if err := store.CreateDueTasks(); err != nil {
+				log.Printf("An error ocurred while creating tasks for account %s: %s", store.accountID, err)
+			}
 		}
-	})
-	c.AddFunc(config.CronUpdateTasks, func() {
-		if err := habitRPG.UpdateStates(); err != nil {
-			log.Printf("An error ocurred while fetching tasks: %s", err)
+		// Safety net for changes not passed to the scheduler
+		resyncScheduler()
+	}))
+	c.AddFunc(config.CronUpdateTasks, jobs.wrap(func() {
+		for _, store := range accounts.Stores() {
+			if !store.hasCredentials() {
+				continue
+			}
+			if err := store.UpdateStates(); err != nil && err != habitrpg.ErrCircuitOpen {
+				log.Printf("An error ocurred while fetching tasks for account %s: %s", store.accountID, err)
+			}
+			store.checkOverdue()
 		}
-	})
+	}))
 	c.Start()
 
 	// API interface
+	api := mux.NewRouter()
+
+	v1 := api.PathPrefix("/v1/").Subrouter()
+	v1.HandleFunc("/tasks", withStore(handleCreateTask)).Methods("POST").Name("create_task")
+	v1.HandleFunc("/tasks", withStore(handleGetTasks)).Methods("GET").Name("list_tasks")
+	v1.HandleFunc("/tasks/{taskid}", withStore(handleUpdateTask)).Methods("PUT").Name("update_task")
+	v1.HandleFunc("/tasks/{taskid}", withStore(handleDeleteTask)).Methods("DELETE").Name("delete_task")
+	v1.HandleFunc("/tasks/{taskid}/trigger", withStore(handleTaskTrigger)).Methods("POST").Name("trigger_task")
+	v1.HandleFunc("/tasks/{taskid}/pause", withStore(handleTaskPause(true))).Methods("POST").Name("pause_task")
+	v1.HandleFunc("/tasks/{taskid}/resume", withStore(handleTaskPause(false))).Methods("POST").Name("resume_task")
+	v1.HandleFunc("/tasks/{taskid}/complete", withStore(handleTaskComplete)).Methods("POST").Name("complete_task")
+	v1.HandleFunc("/events", withStore(handleEventStream)).Methods("GET").Name("event_stream")
+	v1.HandleFunc("/outbox", withStore(handleGetOutbox)).Methods("GET").Name("list_outbox")
+	v1.HandleFunc("/habitica", handleHabiticaStatus).Methods("GET").Name("habitica_status")
+	v1.HandleFunc("/export", withStore(handleExport)).Methods("GET").Name("export")
+	v1.HandleFunc("/import", withStore(handleImport)).Methods("POST").Name("import")
+	v1.HandleFunc("/schedule/preview", handleSchedulePreview).Methods("POST").Name("schedule_preview")
+	v1.HandleFunc("/info", handleInfo).Methods("GET").Name("info")
+	v1.HandleFunc("/webhooks", handleGetWebhooks).Methods("GET").Name("list_webhooks")
+	v1.HandleFunc("/webhooks/deliveries", handleGetWebhookDeliveries).Methods("GET").Name("list_webhook_deliveries")
+	v1.HandleFunc("/accounts", handleGetAccounts).Methods("GET").Name("list_accounts")
+	v1.HandleFunc("/accounts/{accountid}", handlePutAccount).Methods("PUT").Name("put_account")
+	v1.HandleFunc("/accounts/{accountid}", handleDeleteAccount).Methods("DELETE").Name("delete_account")
+
 	r := mux.NewRouter()
+	r.Handle("/metrics", requireAPIToken(http.HandlerFunc(handleMetrics))).Methods("GET")
+	r.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	r.HandleFunc("/readyz", handleReadyz).Methods("GET")
+	r.PathPrefix("/v1/").Handler(instrumentAPI(api, requireStore(requireAPIToken(requireLeader(api)))))
+	r.PathPrefix("/").Handler(uiHandler())
 
-	v1 := r.PathPrefix("/v1/").Subrouter()
-	v1.HandleFunc("/tasks", handleCreateTask).Methods("POST")
-	v1.HandleFunc("/tasks", handleGetTasks).Methods("GET")
-	v1.HandleFunc("/tasks/{taskid}", handleDeleteTask).Methods("DELETE")
-	v1.HandleFunc("/tasks/{taskid}/trigger", handleTaskTrigger).Methods("POST")
+	srv := &http.Server{
+		Addr:    config.ListenAddress,
+		Handler: &MyServer{r},
+	}
+	// Event streams only end when the client disconnects
+	srv.RegisterOnShutdown(stream.closeAll)
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error while listening for API requests: %s", err)
+			os.Exit(1)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
 
-	http.Handle("/", &MyServer{r})
-	http.ListenAndServe(config.ListenAddress, nil)
+	log.Printf("Received %s, shutting down...", sig)
+	if err := shutdown(srv, c, jobs); err != nil {
+		log.Printf("Shutdown incomplete: %s", err)
+		os.Exit(1)
+	}
+	log.Println("Shutdown complete")
 }
 
-func handleCreateTask(res http.ResponseWriter, r *http.Request) {
+func handleCreateTask(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(res, "Unable to read task data", http.StatusInternalServerError)
@@ -94,55 +354,338 @@ func handleCreateTask(res http.ResponseWriter, r *http.Request) {
 	}
 	task, err := NewTaskWithChecks(body)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	habitRPG.Tasks = append(habitRPG.Tasks, *task)
-	habitRPG.Save()
+	link, err := parseTodoLink(body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if link.requested() {
+		todo, err := store.resolveTodoLink(link)
+		if err != nil {
+			writeLinkError(res, err)
+			return
+		}
+		task.adoptTodo(todo)
+	}
+
+	store.lock.Lock()
+	if task.LastTaskID != "" {
+		if other := store.linkedTask(task.LastTaskID); other != "" {
+			store.lock.Unlock()
+			http.Error(res, fmt.Sprintf("Todo is already linked to task %s", other), http.StatusConflict)
+			return
+		}
+	}
+	store.Tasks = append(store.Tasks, *task)
+	store.lock.Unlock()
+	rearmScheduler(store.accountID, task.ID)
+	publishEvent(newEvent(eventTaskCreated, store.accountID, task, nil))
+
+	if !commitChange(store, res, r) {
+		return
+	}
+
+	data, _ := json.Marshal(task)
+
+	res.Header().Add("Content-Type", "application/json")
+	res.WriteHeader(http.StatusCreated)
+	res.Write(data)
+}
+
+func handleGetTasks(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
+	store.lock.RLock()
+	data, _ := json.Marshal(store.Tasks)
+	store.lock.RUnlock()
+
+	res.Header().Add("Content-Type", "application/json")
+	res.Write(data)
+}
+
+func handleUpdateTask(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(res, "Unable to read task data", http.StatusInternalServerError)
+		return
+	}
+
+	link, err := parseTodoLink(body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var todo *habitrpg.Task
+	if link.requested() {
+		if todo, err = store.resolveTodoLink(link); err != nil {
+			writeLinkError(res, err)
+			return
+		}
+	}
+
+	store.lock.Lock()
+	found, linkedTo := false, ""
+	var (
+		updated HabitTask
+		linkErr error
+	)
+	for i := range store.Tasks {
+		if store.Tasks[i].ID == vars["taskid"] {
+			found = true
+			if todo != nil {
+				if linkedTo = store.linkedTask(todo.ID); linkedTo == store.Tasks[i].ID {
+					linkedTo = ""
+				}
+				if linkedTo != "" {
+					break
+				}
+			}
+			task := store.Tasks[i]
+			oldTitle := task.Title
+			if err = task.UpdateWithChecks(body); err != nil {
+				break
+			}
+
+			switch {
+			case todo != nil:
+				linkErr = store.linkTodo(&task, todo)
+			case task.Title != oldTitle && task.LastTaskID != "" && !task.IsCompleted:
+				// Keep the text of the open todo in sync
+				store.enqueue(OutboxOperation{Kind: outboxUpdate, TaskID: task.ID, TodoID: task.LastTaskID, Text: task.Title})
+			}
+			if linkErr == nil {
+				store.Tasks[i] = task
+				updated = task
+			}
+			break
+		}
+	}
+	store.lock.Unlock()
+
+	switch {
+	case !found:
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	case linkedTo != "":
+		http.Error(res, fmt.Sprintf("Todo is already linked to task %s", linkedTo), http.StatusConflict)
+		return
+	case linkErr != nil:
+		writeLinkError(res, linkErr)
+		return
+	case err != nil:
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rearmScheduler(store.accountID, updated.ID)
+	publishEvent(newEvent(eventTaskUpdated, store.accountID, &updated, nil))
+
+	if !commitChange(store, res, r) {
+		return
+	}
 
 	res.Header().Add("Content-Type", "text/plain")
 	res.Write([]byte("OK"))
 }
 
-func handleGetTasks(res http.ResponseWriter, r *http.Request) {
-	data, _ := json.Marshal(habitRPG.Tasks)
+func handleSchedulePreview(res http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(res, "Unable to read task data", http.StatusInternalServerError)
+		return
+	}
+
+	task, err := parseTaskInput(body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count := 5
+	if c, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && c > 0 && c <= 100 {
+		count = c
+	}
+
+	data, _ := json.Marshal(task.PreviewEntryDates(count))
 
 	res.Header().Add("Content-Type", "application/json")
 	res.Write(data)
 }
 
-func handleDeleteTask(res http.ResponseWriter, r *http.Request) {
+func handleDeleteTask(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
 	tmp := []HabitTask{}
 	vars := mux.Vars(r)
 
-	for _, task := range habitRPG.Tasks {
+	deleteTodo, _ := strconv.ParseBool(r.URL.Query().Get("delete_todo"))
+
+	var deleted *HabitTask
+	store.lock.Lock()
+	for _, task := range store.Tasks {
 		if task.ID != vars["taskid"] {
 			tmp = append(tmp, task)
+			continue
 		}
+
+		store.dropOperations(task.ID)
+		if deleteTodo && task.LastTaskID != "" && !task.IsCompleted {
+			store.enqueue(OutboxOperation{Kind: outboxDelete, TaskID: task.ID, TodoID: task.LastTaskID})
+		}
+		t := task
+		deleted = &t
 	}
+	store.Tasks = tmp
+	store.lock.Unlock()
+	rearmScheduler(store.accountID, vars["taskid"])
 
-	habitRPG.Tasks = tmp
+	if deleted != nil {
+		publishEvent(newEvent(eventTaskDeleted, store.accountID, deleted, nil))
+	}
+
+	if !commitChange(store, res, r) {
+		return
+	}
 
 	res.Header().Add("Content-Type", "text/plain")
 	res.Write([]byte("OK"))
 }
 
-func handleTaskTrigger(res http.ResponseWriter, r *http.Request) {
+func handleTaskTrigger(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
+	if !store.triggerTask(mux.Vars(r)["taskid"]) {
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if !commitChange(store, res, r) {
+		return
+	}
+
+	http.Error(res, "OK", http.StatusOK)
+}
+
+// handleTaskComplete completes the open todo of the task in HabitRPG, the
+// task is updated as soon as HabitRPG accepted it
+func handleTaskComplete(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	res.Header().Add("Content-Type", "text/plain")
+	found, open := false, false
+	store.lock.Lock()
+	for i := range store.Tasks {
+		task := &store.Tasks[i]
+		if task.ID != vars["taskid"] {
+			continue
+		}
+
+		found = true
+		if open = task.LastTaskID != "" && !task.IsCompleted; open {
+			store.enqueue(OutboxOperation{Kind: outboxScore, TaskID: task.ID, TodoID: task.LastTaskID})
+		}
+		break
+	}
+	store.lock.Unlock()
+
+	switch {
+	case !found:
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	case !open:
+		http.Error(res, "Task has no open todo", http.StatusConflict)
+		return
+	}
 
-	for i := range habitRPG.Tasks {
-		if habitRPG.Tasks[i].ID == vars["taskid"] {
-			habitRPG.Tasks[i].NextEntryDate = time.Now()
-			http.Error(res, "OK", http.StatusOK)
+	if !commitChange(store, res, r) {
+		return
+	}
+
+	http.Error(res, "Accepted", http.StatusAccepted)
+}
+
+func handleExport(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
+	export := store.Export()
+	export.Settings = accounts.Settings(store.accountID)
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		http.Error(res, "Unable to serialize export", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	res.Header().Add("Content-Disposition", "attachment; filename=\"habitscheduler-export.json\"")
+	res.Write(data)
+}
+
+func handleImport(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(res, "Unable to read import data", http.StatusInternalServerError)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = importModeMerge
+	}
+	onConflict := r.URL.Query().Get("on_conflict")
+	if onConflict == "" {
+		onConflict = importConflictSkip
+	}
+
+	before := store.Export().Tasks
+	result, err := store.Import(body, mode, onConflict)
+	rearmSchedulerAccount(store.accountID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	publishImportEvents(store, before)
+
+	if !commitChange(store, res, r) {
+		return
+	}
+
+	if result.Settings != nil {
+		if err := accounts.ApplySettings(store.accountID, *result.Settings); err != nil {
+			http.Error(res, fmt.Sprintf("Tasks were imported but the settings could not be saved: %s", err), http.StatusInternalServerError)
 			return
 		}
 	}
 
-	res.Write([]byte("Not Found"))
-	http.Error(res, "Not found", http.StatusNotFound)
+	data, _ := json.Marshal(result)
+	res.Header().Add("Content-Type", "application/json")
+	res.Write(data)
+}
+
+func handleTaskPause(paused bool) storeHandlerFunc {
+	return func(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		var updated *HabitTask
+		store.lock.Lock()
+		if task := store.task(vars["taskid"]); task != nil {
+			task.IsPaused = paused
+			t := *task
+			updated = &t
+		}
+		store.lock.Unlock()
+
+		if updated == nil {
+			http.Error(res, "Not found", http.StatusNotFound)
+			return
+		}
+
+		rearmScheduler(store.accountID, updated.ID)
+		publishEvent(newEvent(eventTaskUpdated, store.accountID, updated, nil))
+		if !commitChange(store, res, r) {
+			return
+		}
+
+		http.Error(res, "OK", http.StatusOK)
+	}
 }
 
 type MyServer struct {
@@ -150,7 +693,8 @@ type MyServer struct {
 }
 
 func (s *MyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if origin := req.Header.Get("Origin"); origin != "" {
+	if origin := req.Header.Get("Origin"); origin != "" && corsOriginAllowed(origin) {
+		rw.Header().Set("Vary", "Origin")
 		rw.Header().Set("Access-Control-Allow-Origin", origin)
 		rw.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 		rw.Header().Set("Access-Control-Allow-Headers",
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	configLock   sync.Mutex
+	configFree   = sync.NewCond(&configLock)
+	configHolder string // Name of the test owning the configuration
+)
+
+// withConfig applies change to the configuration until the end of the test.
+// As config is a global only one test at a time may change it: the test
+// calling withConfig first owns the configuration until it ends, other tests
+// (including parallel ones) block in withConfig until then. Subtests of the
+// owner may change it as well as long as they do not run in parallel.
+func withConfig(t *testing.T, change func(*configuration)) {
+	t.Helper()
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	for configHolder != "" && t.Name() != configHolder && !strings.HasPrefix(t.Name(), configHolder+"/") {
+		configFree.Wait()
+	}
+
+	owner := configHolder == ""
+	if owner {
+		configHolder = t.Name()
+	}
+
+	saved := config
+	t.Cleanup(func() {
+		configLock.Lock()
+		defer configLock.Unlock()
+
+		config = saved
+		if owner {
+			configHolder = ""
+			configFree.Broadcast()
+		}
+	})
+
+	change(&config)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+	"github.com/gorilla/mux"
+)
+
+// The metrics are exposed in the Prometheus text format. The few metric
+// types needed are implemented here instead of pulling in the client library.
+
+var defaultDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+
+	value   float64
+	count   uint64
+	buckets []uint64
+}
+
+var metricsRegistry = []*metricVec{}
+
+func newMetricVec(kind, name, help string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricSeries{},
+	}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec("counter", name, help, nil, labels...)
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec("gauge", name, help, nil, labels...)
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return newMetricVec("histogram", name, help, buckets, labels...)
+}
+
+func (m *metricVec) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{
+			labelValues: append([]string{}, labelValues...),
+			buckets:     make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Inc increases a counter by one
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Add increases a counter by v
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.get(labelValues).value += v
+}
+
+// Set sets the value of a gauge
+func (m *metricVec) Set(v float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.get(labelValues).value = v
+}
+
+// Reset removes all series, used for gauges calculated on every scrape
+func (m *metricVec) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.series = map[string]*metricSeries{}
+}
+
+// Observe records a value into a histogram
+func (m *metricVec) Observe(v float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s := m.get(labelValues)
+	s.value += v
+	s.count++
+	for i, le := range m.buckets {
+		if v <= le {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (m *metricVec) write(buf *bytes.Buffer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := []string{}
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, le := range m.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatFloat(le)), s.buckets[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatFloat(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	parts := []string{}
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, n, labelValueEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metricTodosCreated = newCounterVec("habitscheduler_habitica_todos_created_total",
+		"Number of todos created in HabitRPG", "account")
+	metricTodosAdopted = newCounterVec("habitscheduler_habitica_todos_adopted_total",
+		"Number of existing todos adopted instead of creating a duplicate", "account")
+	metricTodosFailed = newCounterVec("habitscheduler_habitica_todos_failed_total",
+		"Number of todos which could not be created in HabitRPG", "account")
+
+	metricOutboxOperations = newCounterVec("habitscheduler_outbox_operations_total",
+		"Number of executed outbox operations by kind (create, update, delete, score) and result", "account", "kind", "result")
+	metricOutboxPending = newGaugeVec("habitscheduler_outbox_pending",
+		"Number of operations waiting in the outbox", "account")
+
+	metricEvents = newCounterVec("habitscheduler_events_total",
+		"Number of published events by type", "type")
+	metricWebhookDeliveries = newCounterVec("habitscheduler_webhook_deliveries_total",
+		"Number of webhook delivery attempts and dropped deliveries by result (delivered, retry, failed, dropped)", "result")
+	metricEmails = newCounterVec("habitscheduler_emails_total",
+		"Number of email notifications sent by result (sent, error)", "result")
+	metricMQTTConnected = newGaugeVec("habitscheduler_mqtt_connected",
+		"Whether the connection to the MQTT broker is established")
+	metricMQTTPublished = newCounterVec("habitscheduler_mqtt_published_total",
+		"Number of events queued for MQTT by result (queued, dropped)", "result")
+	metricMQTTCommands = newCounterVec("habitscheduler_mqtt_commands_total",
+		"Number of commands received through MQTT by action (trigger, unknown) and result (ok, not_found, ignored, invalid)", "action", "result")
+
+	metricUpdateStates = newCounterVec("habitscheduler_update_states_total",
+		"Number of state updates fetched from HabitRPG by result (success, error, skipped, circuit_open)", "account", "result")
+	metricUpdateStatesDuration = newHistogramVec("habitscheduler_update_states_duration_seconds",
+		"Duration of state updates fetched from HabitRPG", defaultDurationBuckets, "account", "result")
+
+	metricHabiticaRequests = newCounterVec("habitscheduler_habitica_requests_total",
+		"Number of requests to the HabitRPG API by endpoint and status code", "method", "endpoint", "code")
+	metricHabiticaDuration = newHistogramVec("habitscheduler_habitica_request_duration_seconds",
+		"Latency of requests to the HabitRPG API by endpoint", defaultDurationBuckets, "method", "endpoint")
+
+	metricBreakerState = newGaugeVec("habitscheduler_habitica_breaker_state",
+		"Current state of the HabitRPG circuit breaker (closed, open, half-open)", "state")
+	metricBreakerTransitions = newCounterVec("habitscheduler_habitica_breaker_transitions_total",
+		"Number of changes of the HabitRPG circuit breaker by new state", "state")
+
+	metricHTTPRequests = newCounterVec("habitscheduler_http_requests_total",
+		"Number of API requests by route and status code", "method", "route", "code")
+	metricHTTPDuration = newHistogramVec("habitscheduler_http_request_duration_seconds",
+		"Latency of API requests by route", defaultDurationBuckets, "method", "route")
+
+	metricStoreLoaded = newGaugeVec("habitscheduler_store_loaded",
+		"Whether the state was loaded from Redis")
+	metricPersist = newCounterVec("habitscheduler_persist_total",
+		"Number of attempts to save the state to Redis by result", "result")
+	metricPersistFailing = newGaugeVec("habitscheduler_persist_failing_seconds",
+		"Seconds since saving the state to Redis started failing, 0 if the last save succeeded")
+
+	metricJournalEntries = newCounterVec("habitscheduler_journal_entries_total",
+		"Number of entries appended to task journals")
+	metricJournalCompactions = newCounterVec("habitscheduler_journal_compactions_total",
+		"Number of task journals compacted into a snapshot")
+
+	metricLeader = newGaugeVec("habitscheduler_leader",
+		"Whether this instance is the leader running the scheduling")
+
+	metricTasks = newGaugeVec("habitscheduler_tasks",
+		"Number of scheduled tasks by state (waiting, open, paused)", "account", "state")
+	metricNextDue = newGaugeVec("habitscheduler_next_due_seconds",
+		"Seconds until the next waiting task is due (negative if it is overdue)", "account")
+	metricTaskOverdue = newGaugeVec("habitscheduler_task_overdue_seconds",
+		"Seconds the task is overdue: since its entry date for open or due tasks, 0 otherwise", "account", "task")
+)
+
+var (
+	habiticaIDPattern      = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	occurrenceAliasPattern = regexp.MustCompile(occurrenceAliasPrefix + `[0-9a-fA-F-]{36}-[0-9]+`)
+)
+
+// observeHabiticaRequest is attached to the HabitRPG clients to record the
+// latency and status of every API request. IDs and aliases are removed from
+// the path to keep the number of series bounded.
+func observeHabiticaRequest(method, path string, statusCode int, duration time.Duration) {
+	endpoint := path
+	if i := strings.Index(endpoint, "?"); i >= 0 {
+		endpoint = endpoint[:i]
+	}
+	endpoint = occurrenceAliasPattern.ReplaceAllString(endpoint, ":alias")
+	endpoint = habiticaIDPattern.ReplaceAllString(endpoint, ":id")
+
+	code := "error"
+	if statusCode > 0 {
+		code = strconv.Itoa(statusCode)
+	}
+
+	metricHabiticaRequests.Inc(method, endpoint, code)
+	metricHabiticaDuration.Observe(duration.Seconds(), method, endpoint)
+}
+
+// scrapeLock serializes scrapes as the gauges calculated by one scrape are
+// reset and set again while another one might be writing them
+var scrapeLock sync.Mutex
+
+// updateTaskMetrics calculates the gauges describing the current tasks, it
+// must be called with the scrapeLock held
+func updateTaskMetrics() {
+	metricTasks.Reset()
+	metricNextDue.Reset()
+	metricTaskOverdue.Reset()
+	metricOutboxPending.Reset()
+
+	loaded := 0.0
+	if storeReady.Load() {
+		loaded = 1
+	}
+	metricStoreLoaded.Set(loaded)
+
+	leader := 0.0
+	if isLeader() {
+		leader = 1
+	}
+	metricLeader.Set(leader)
+	metricPersistFailing.Set(persistence.FailingFor().Seconds())
+
+	if mqttClient != nil {
+		connected := 0.0
+		if mqttClient.Connected() {
+			connected = 1
+		}
+		metricMQTTConnected.Set(connected)
+	}
+
+	if habiticaBreaker != nil {
+		current := habiticaBreaker.Status().State
+		for _, state := range []string{habitrpg.BreakerClosed, habitrpg.BreakerOpen, habitrpg.BreakerHalfOpen} {
+			v := 0.0
+			if state == current {
+				v = 1
+			}
+			metricBreakerState.Set(v, state)
+		}
+	}
+
+	if !storeReady.Load() {
+		return
+	}
+
+	now := time.Now()
+	for _, store := range accounts.Stores() {
+		counts := map[string]float64{"waiting": 0, "open": 0, "paused": 0}
+		var nextDue time.Time
+
+		store.lock.RLock()
+		for _, t := range store.Tasks {
+			state := t.stateString()
+			counts[state]++
+
+			if state == "waiting" && (nextDue.IsZero() || t.NextEntryDate.Before(nextDue)) {
+				nextDue = t.NextEntryDate
+			}
+
+			overdue := 0.0
+			if state != "paused" && now.After(t.NextEntryDate) {
+				overdue = now.Sub(t.NextEntryDate).Seconds()
+			}
+			metricTaskOverdue.Set(overdue, store.accountID, t.ID)
+		}
+		pending := len(store.Outbox)
+		store.lock.RUnlock()
+
+		metricOutboxPending.Set(float64(pending), store.accountID)
+
+		for state, n := range counts {
+			metricTasks.Set(n, store.accountID, state)
+		}
+		if !nextDue.IsZero() {
+			metricNextDue.Set(nextDue.Sub(now).Seconds(), store.accountID)
+		}
+	}
+}
+
+func handleMetrics(res http.ResponseWriter, r *http.Request) {
+	buf := new(bytes.Buffer)
+
+	scrapeLock.Lock()
+	updateTaskMetrics()
+	for _, m := range metricsRegistry {
+		m.write(buf)
+	}
+	scrapeLock.Unlock()
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	res.Write(buf.Bytes())
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes through for streaming responses
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentAPI records count and latency of requests to the API router
+// labeled by the name of the matched route
+func instrumentAPI(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route.GetName() != "" {
+			route = match.Route.GetName()
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: res}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		metricHTTPRequests.Inc(r.Method, route, strconv.Itoa(rec.status))
+		metricHTTPDuration.Observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
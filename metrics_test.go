@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentScrapes(t *testing.T) {
+	savedAccounts, savedReady := accounts, storeReady.Load()
+	t.Cleanup(func() {
+		accounts = savedAccounts
+		storeReady.Store(savedReady)
+	})
+
+	accounts = newTestRegistry(t, newTestStorage(t))
+	storeReady.Store(true)
+
+	store := accounts.Store(defaultAccountID)
+	store.lock.Lock()
+	for i := 0; i < 500; i++ {
+		id := strconv.Itoa(i)
+		store.Tasks = append(store.Tasks, dueTestTask(id, id))
+	}
+	store.lock.Unlock()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res := httptest.NewRecorder()
+			handleMetrics(res, httptest.NewRequest("GET", "/metrics", nil))
+
+			// Every scrape has to contain the gauges of all tasks, not the
+			// partial state of a concurrent scrape
+			body := res.Body.String()
+			if n := strings.Count(body, "habitscheduler_task_overdue_seconds{"); n != 500 {
+				t.Errorf("Expected overdue gauges of 500 tasks, got %d", n)
+			}
+			if !strings.Contains(body, `habitscheduler_tasks{account="default",state="waiting"} 500`) {
+				t.Errorf("Task counts missing in scrape")
+			}
+		}()
+	}
+	wg.Wait()
+}
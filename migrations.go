@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// migration upgrades a persisted store document by exactly one schema version.
+// The document is passed in its generic JSON representation so migrations do
+// not depend on the current shape of the Go structs.
+type migration func(doc map[string]interface{}) error
+
+// migrations is the ordered list of upgrades: migrations[i] takes a document
+// from schema version i to version i+1. New entries must only be appended.
+var migrations = []migration{
+	migrateV0ToV1,
+	migrateV1ToV2,
+}
+
+// currentSchemaVersion is the version written by Save
+var currentSchemaVersion = len(migrations)
+
+const schemaVersionKey = "SchemaVersion"
+
+// migrateStoreDocument upgrades the given store JSON to the current schema
+// version and returns the upgraded JSON
+func migrateStoreDocument(data []byte) ([]byte, error) {
+	doc := map[string]interface{}{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	version, err := documentSchemaVersion(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if version > currentSchemaVersion {
+		return nil, fmt.Errorf("Stored data has schema version %d, this build only supports up to %d", version, currentSchemaVersion)
+	}
+
+	if version == currentSchemaVersion {
+		return data, nil
+	}
+
+	for v := version; v < currentSchemaVersion; v++ {
+		if err := migrations[v](doc); err != nil {
+			return nil, fmt.Errorf("Migration from schema version %d to %d failed: %s", v, v+1, err)
+		}
+		doc[schemaVersionKey] = v + 1
+	}
+
+	return json.Marshal(doc)
+}
+
+func documentSchemaVersion(doc map[string]interface{}) (int, error) {
+	raw, ok := doc[schemaVersionKey]
+	if !ok || raw == nil {
+		// Documents written before versioning was introduced
+		return 0, nil
+	}
+
+	n, ok := raw.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("Invalid schema version %v", raw)
+	}
+
+	v, err := n.Int64()
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("Invalid schema version %v", raw)
+	}
+
+	return int(v), nil
+}
+
+// migrateV0ToV1 handles documents written before the schema version was
+// stored. Those only contain the task list, tasks having RepeatCron set
+// without a cron entry are normalized the same way NewTaskWithChecks does.
+func migrateV0ToV1(doc map[string]interface{}) error {
+	tasks, ok := doc["Tasks"]
+	if !ok || tasks == nil {
+		doc["Tasks"] = []interface{}{}
+		return nil
+	}
+
+	list, ok := tasks.([]interface{})
+	if !ok {
+		return fmt.Errorf("Tasks is not a list")
+	}
+
+	for _, t := range list {
+		task, ok := t.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Task is not an object")
+		}
+
+		if entry, _ := task["RepeatCronEntry"].(string); entry == "" {
+			task["RepeatCron"] = false
+		}
+	}
+
+	return nil
+}
+
+// migrateV1ToV2 adds the OnDelete policy introduced to tell deleted from
+// completed todos. Existing tasks get the skip policy which is closest to the
+// former behaviour of treating deleted todos as completed.
+func migrateV1ToV2(doc map[string]interface{}) error {
+	list, ok := doc["Tasks"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, t := range list {
+		task, ok := t.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Task is not an object")
+		}
+
+		if policy, _ := task["OnDelete"].(string); policy == "" {
+			task["OnDelete"] = onDeleteSkip
+		}
+	}
+
+	return nil
+}
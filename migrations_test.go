@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files in testdata")
+
+func TestMigrateStoreDocumentGolden(t *testing.T) {
+	for _, name := range []string{"store_v0", "store_v1"} {
+		t.Run(name, func(t *testing.T) {
+			input, err := ioutil.ReadFile(filepath.Join("testdata", name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := migrateStoreDocument(input)
+			if err != nil {
+				t.Fatalf("Migration failed: %s", err)
+			}
+
+			golden := filepath.Join("testdata", name+".golden.json")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, out, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, expected) {
+				t.Errorf("Migrated document differs from %s:\n got: %s\nwant: %s", golden, out, expected)
+			}
+		})
+	}
+}
+
+func TestMigrateStoreDocumentCurrent(t *testing.T) {
+	input, err := ioutil.ReadFile(filepath.Join("testdata", "store_v0.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := migrateStoreDocument(input)
+	if err != nil {
+		t.Fatalf("Loading the current schema version failed: %s", err)
+	}
+	if !bytes.Equal(out, input) {
+		t.Errorf("Document of the current schema version was modified:\n got: %s\nwant: %s", out, input)
+	}
+}
+
+func TestMigrateStoreDocumentRejects(t *testing.T) {
+	for name, input := range map[string]string{
+		"negative version": `{"SchemaVersion":-1,"Tasks":[]}`,
+		"invalid version":  `{"SchemaVersion":"2","Tasks":[]}`,
+		"tasks not a list": `{"Tasks":{}}`,
+		"invalid JSON":     `{"Tasks":[`,
+	} {
+		if _, err := migrateStoreDocument([]byte(input)); err == nil {
+			t.Errorf("%s: document %s was accepted", name, input)
+		}
+	}
+
+	newer := fmt.Sprintf(`{"SchemaVersion":%d,"Tasks":[]}`, currentSchemaVersion+1)
+	_, err := migrateStoreDocument([]byte(newer))
+	if err == nil || !strings.Contains(err.Error(), "only supports up to") {
+		t.Errorf("Newer schema version not rejected as unsupported: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/satori/go.uuid"
+)
+
+// Actions which can be sent to the --mqtt-command-topic
+const (
+	mqttActionTrigger = "trigger" // Same as POST /v1/tasks/{taskid}/trigger
+)
+
+const (
+	mqttQueueSize      = 1000
+	mqttReconnectMax   = 2 * time.Minute
+	mqttDisconnectWait = 250 // Milliseconds to finish sending on shutdown
+	mqttPublishTimeout = 10 * time.Second
+)
+
+// mqttClient is nil if no --mqtt-url is configured
+var mqttClient *mqttPublisher
+
+// mqttCommand is the payload of a message on the --mqtt-command-topic
+type mqttCommand struct {
+	Task   string `json:"task"`
+	Action string `json:"action"`
+}
+
+// mqttMessage is an event waiting to be published
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// mqttPublisher queues the events for the broker so the event bus is not
+// blocked while the broker is slow or not reachable. The connection is kept
+// up by the paho client which buffers messages while reconnecting.
+type mqttPublisher struct {
+	client        paho.Client
+	connected     chan struct{}
+	connectedOnce sync.Once
+
+	queue chan mqttMessage
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newMQTTClient() (*mqttPublisher, error) {
+	if config.MQTTURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(config.MQTTURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid MQTT URL: %s", err)
+	}
+
+	if config.MQTTQoS != 0 && config.MQTTQoS != 1 {
+		return nil, fmt.Errorf("MQTT QoS must be 0 or 1")
+	}
+	if !validEventFilter(config.MQTTEvents) {
+		return nil, fmt.Errorf("Unknown event type in --mqtt-events, available are: %s", strings.Join(eventTypes, ", "))
+	}
+
+	var filter string
+	if config.MQTTCommandTopic != "" {
+		if filter, err = mqttCommandFilter(config.MQTTCommandTopic); err != nil {
+			return nil, err
+		}
+	}
+
+	clientID := config.MQTTClientID
+	if clientID == "" {
+		if leadership != nil {
+			clientID = "habitscheduler-" + leadership.instanceID
+		} else {
+			host, _ := os.Hostname()
+			clientID = "habitscheduler-" + host + "-" + uuid.NewV4().String()[:8]
+		}
+	}
+
+	p := &mqttPublisher{
+		connected: make(chan struct{}),
+		queue:     make(chan mqttMessage, mqttQueueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(config.MQTTURL).
+		SetClientID(clientID).
+		SetCleanSession(true).
+		SetOrderMatters(false).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttReconnectMax).
+		SetWriteTimeout(mqttPublishTimeout).
+		SetOnConnectHandler(func(c paho.Client) {
+			log.Printf("Connected to MQTT broker %s", u.Host)
+			p.setConnected()
+
+			// Subscriptions end with the session and are made again
+			if filter != "" {
+				c.Subscribe(filter, 1, handleMQTTMessage)
+			}
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Printf("Connection to MQTT broker lost, reconnecting: %s", err)
+		})
+
+	p.client = paho.NewClient(opts)
+	return p, nil
+}
+
+// Start connects to the broker in the background and starts publishing
+func (p *mqttPublisher) Start() {
+	p.client.Connect()
+	go p.run()
+}
+
+// Stop publishes the queued events if connected and disconnects
+func (p *mqttPublisher) Stop() {
+	close(p.stop)
+	<-p.done
+	p.client.Disconnect(mqttDisconnectWait)
+}
+
+// Connected reports whether the connection to the broker is established
+func (p *mqttPublisher) Connected() bool {
+	return p.client.IsConnectionOpen()
+}
+
+// Publish queues a message, it fails if the queue is full
+func (p *mqttPublisher) Publish(m mqttMessage) error {
+	select {
+	case p.queue <- m:
+		return nil
+	default:
+		return fmt.Errorf("MQTT publish queue is full")
+	}
+}
+
+func (p *mqttPublisher) setConnected() {
+	p.connectedOnce.Do(func() { close(p.connected) })
+}
+
+// run hands the queued messages to paho. Before the first connection was
+// established they are kept in the queue as paho drops them when the session
+// starts, afterwards paho keeps them while reconnecting.
+func (p *mqttPublisher) run() {
+	defer close(p.done)
+
+	select {
+	case <-p.connected:
+	case <-p.stop:
+		return
+	}
+
+	for {
+		select {
+		case m := <-p.queue:
+			p.send(m)
+		case <-p.stop:
+			for {
+				select {
+				case m := <-p.queue:
+					p.send(m).WaitTimeout(mqttPublishTimeout)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *mqttPublisher) send(m mqttMessage) paho.Token {
+	return p.client.Publish(m.Topic, byte(config.MQTTQoS), false, m.Payload)
+}
+
+// mqttCommandFilter turns the --mqtt-command-topic into a subscription
+// matching the topics of all accounts
+func mqttCommandFilter(topic string) (string, error) {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if level == "{account}" {
+			levels[i] = "+"
+			continue
+		}
+		if strings.Contains(level, "{account}") {
+			return "", fmt.Errorf("{account} must be a whole level of the MQTT command topic")
+		}
+	}
+	return strings.Join(levels, "/"), nil
+}
+
+// mqttCommandAccount returns the account a command was sent to, the default
+// account if the --mqtt-command-topic does not contain {account}
+func mqttCommandAccount(topic string) string {
+	levels := strings.Split(config.MQTTCommandTopic, "/")
+	parts := strings.Split(topic, "/")
+	for i, level := range levels {
+		if level == "{account}" && i < len(parts) {
+			return parts[i]
+		}
+	}
+	return defaultAccountID
+}
+
+// publishMQTTEvent is subscribed to the event bus and queues the event to
+// be published to the --mqtt-event-topic. Events are dropped while the
+// queue is full as the broker is not reachable.
+func publishMQTTEvent(e Event) {
+	if !eventMatches(config.MQTTEvents, e.Type) {
+		return
+	}
+
+	taskID := ""
+	if e.Task != nil {
+		taskID = e.Task.ID
+	}
+	topic := strings.NewReplacer(
+		"{account}", e.Account,
+		"{type}", e.Type,
+		"{task}", taskID,
+	).Replace(config.MQTTEventTopic)
+
+	payload, _ := json.Marshal(e)
+	if err := mqttClient.Publish(mqttMessage{Topic: topic, Payload: payload}); err != nil {
+		metricMQTTPublished.Inc("dropped")
+		return
+	}
+	metricMQTTPublished.Inc("queued")
+}
+
+func handleMQTTMessage(_ paho.Client, msg paho.Message) {
+	handleMQTTCommand(msg.Topic(), msg.Payload())
+}
+
+// handleMQTTCommand executes a command received on the --mqtt-command-topic.
+// Commands are only executed by the leader, the other replicas receive them
+// too and ignore them.
+func handleMQTTCommand(topic string, payload []byte) {
+	if !storeReady.Load() || !isLeader() {
+		return
+	}
+
+	var cmd mqttCommand
+	if err := json.Unmarshal(payload, &cmd); err != nil || cmd.Task == "" {
+		log.Printf("Ignoring invalid MQTT command on %s: %s", topic, payload)
+		metricMQTTCommands.Inc(mqttActionLabel(cmd.Action), "invalid")
+		return
+	}
+
+	account := mqttCommandAccount(topic)
+	store := accounts.Store(account)
+	if store == nil {
+		log.Printf("Ignoring MQTT command for unknown account %s", account)
+		metricMQTTCommands.Inc(mqttActionLabel(cmd.Action), "not_found")
+		return
+	}
+
+	switch cmd.Action {
+	case mqttActionTrigger:
+		if !store.triggerTask(cmd.Task) {
+			log.Printf("Ignoring MQTT trigger for unknown task %s of account %s", cmd.Task, account)
+			metricMQTTCommands.Inc(cmd.Action, "not_found")
+			return
+		}
+		store.markChanged()
+		log.Printf("Triggered task %s of account %s through MQTT", cmd.Task, account)
+		metricMQTTCommands.Inc(cmd.Action, "ok")
+
+	default:
+		log.Printf("Ignoring unknown MQTT command action %q", cmd.Action)
+		metricMQTTCommands.Inc(mqttActionLabel(cmd.Action), "ignored")
+	}
+}
+
+// mqttActionLabel maps the action of a command to the metric label, actions
+// not known are counted as unknown so messages can not create new series
+func mqttActionLabel(action string) string {
+	switch action {
+	case mqttActionTrigger:
+		return action
+	}
+	return "unknown"
+}
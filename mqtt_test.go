@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeMQTTBroker accepts one client and reports the packets it sent
+type fakeMQTTBroker struct {
+	ln      net.Listener
+	packets chan packets.ControlPacket
+	pending []packets.ControlPacket
+}
+
+func newFakeMQTTBroker(t *testing.T) *fakeMQTTBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	b := &fakeMQTTBroker{ln: ln, packets: make(chan packets.ControlPacket, 100)}
+	go b.serve()
+	return b
+}
+
+func (b *fakeMQTTBroker) serve() {
+	conn, err := b.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		b.packets <- p
+
+		var reply packets.ControlPacket
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID, suback.ReturnCodes = p.MessageID, p.Qoss
+			reply = suback
+		case *packets.PublishPacket:
+			if p.Qos == 1 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				reply = puback
+			}
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			reply.Write(conn)
+		}
+	}
+}
+
+// next returns the next packet of the given type sent by the client, other
+// packets are kept for later calls
+func (b *fakeMQTTBroker) next(t *testing.T, kind byte) packets.ControlPacket {
+	t.Helper()
+
+	for i, p := range b.pending {
+		if packetType(p) == kind {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			return p
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-b.packets:
+			if packetType(p) == kind {
+				return p
+			}
+			b.pending = append(b.pending, p)
+		case <-timeout:
+			t.Fatalf("Client did not send %s", packets.PacketNames[kind])
+			return nil
+		}
+	}
+}
+
+func packetType(p packets.ControlPacket) byte {
+	switch p.(type) {
+	case *packets.ConnectPacket:
+		return packets.Connect
+	case *packets.SubscribePacket:
+		return packets.Subscribe
+	case *packets.PublishPacket:
+		return packets.Publish
+	case *packets.DisconnectPacket:
+		return packets.Disconnect
+	}
+	return 0
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	b := newFakeMQTTBroker(t)
+	withConfig(t, func(c *configuration) {
+		c.MQTTURL = "tcp://user:secret@" + b.ln.Addr().String()
+		c.MQTTClientID, c.MQTTEvents = "test", nil
+		c.MQTTQoS = 1
+		c.MQTTCommandTopic = "habitscheduler/{account}/command"
+	})
+
+	p, err := newMQTTClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued before the connection is established
+	if err := p.Publish(mqttMessage{Topic: "habitscheduler/default/events/task.created", Payload: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+
+	connect := b.next(t, packets.Connect).(*packets.ConnectPacket)
+	if connect.Username != "user" || string(connect.Password) != "secret" || connect.ClientIdentifier != "test" {
+		t.Errorf("Unexpected CONNECT %s", connect)
+	}
+
+	sub := b.next(t, packets.Subscribe).(*packets.SubscribePacket)
+	if len(sub.Topics) != 1 || sub.Topics[0] != "habitscheduler/+/command" {
+		t.Errorf("Unexpected subscription %v", sub.Topics)
+	}
+
+	pub := b.next(t, packets.Publish).(*packets.PublishPacket)
+	if pub.TopicName != "habitscheduler/default/events/task.created" || pub.Qos != 1 {
+		t.Errorf("Unexpected PUBLISH %s", pub)
+	}
+
+	// Events queued before stopping are sent before disconnecting
+	p.Publish(mqttMessage{Topic: "habitscheduler/default/events/task.deleted", Payload: []byte("{}")})
+	p.Stop()
+	if pub := b.next(t, packets.Publish).(*packets.PublishPacket); pub.TopicName != "habitscheduler/default/events/task.deleted" {
+		t.Errorf("Unexpected PUBLISH %s", pub)
+	}
+	b.next(t, packets.Disconnect)
+}
+
+func TestMQTTCommandTopic(t *testing.T) {
+	for _, c := range []struct {
+		topic, filter, received, account string
+	}{
+		{"habitscheduler/{account}/command", "habitscheduler/+/command", "habitscheduler/alice/command", "alice"},
+		{"home/habits", "home/habits", "home/habits", defaultAccountID},
+	} {
+		withConfig(t, func(cfg *configuration) { cfg.MQTTCommandTopic = c.topic })
+
+		filter, err := mqttCommandFilter(c.topic)
+		if err != nil || filter != c.filter {
+			t.Errorf("Filter of %s: expected %s, got %s (%v)", c.topic, c.filter, filter, err)
+		}
+		if account := mqttCommandAccount(c.received); account != c.account {
+			t.Errorf("Account of %s: expected %s, got %s", c.received, c.account, account)
+		}
+	}
+
+	if _, err := mqttCommandFilter("habitscheduler/x{account}/command"); err == nil {
+		t.Error("Partial {account} level was accepted")
+	}
+}
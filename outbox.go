@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+	"github.com/satori/go.uuid"
+)
+
+// Every write to HabitRPG is recorded as an operation in the outbox of the
+// store first and saved together with the change of the task causing it.
+// Only saved operations are executed, their result is recorded on the task
+// afterwards. Operations interrupted by a crash or failing while HabitRPG is
+// unavailable are executed again later, so all of them must be safe to
+// repeat: todos are created with the occurrence alias and adopted if they
+// exist already, updates and deletes are idempotent and a todo is only
+// scored if it is not completed yet.
+
+const (
+	outboxCreate = "create" // Create the todo of the current occurrence
+	outboxUpdate = "update" // Update the text of an open todo
+	outboxDelete = "delete" // Delete an open todo
+	outboxScore  = "score"  // Complete an open todo
+
+	outboxRetryStart   = 30 * time.Second
+	outboxRetryMax     = 30 * time.Minute
+	outboxPollInterval = 15 * time.Second
+)
+
+// OutboxOperation is a write to HabitRPG not executed successfully yet
+type OutboxOperation struct {
+	ID     string
+	Kind   string
+	TaskID string
+	TodoID string    `json:",omitempty"` // Todo to update, delete or score
+	Alias  string    `json:",omitempty"` // Alias of the todo to create
+	Text   string    `json:",omitempty"`
+	Due    time.Time `json:",omitempty"` // Scheduled time of the occurrence to create
+
+	Created     time.Time
+	Attempts    int
+	LastError   string `json:",omitempty"`
+	NextAttempt time.Time
+}
+
+// enqueue adds the operation to the outbox and marks the store changed so
+// the operation gets saved. The store must be locked by the caller.
+func (h *HabitTaskStore) enqueue(op OutboxOperation) OutboxOperation {
+	op.ID = uuid.NewV4().String()
+	op.Created = time.Now()
+	op.NextAttempt = op.Created
+
+	h.Outbox = append(h.Outbox, op)
+	h.markChanged()
+	outbox.notify()
+
+	return op
+}
+
+// dropOperations removes the operations of a deleted task which have not
+// been executed yet, except for deleting its todo. The store must be locked
+// by the caller.
+func (h *HabitTaskStore) dropOperations(taskID string) {
+	kept := []OutboxOperation{}
+	for _, op := range h.Outbox {
+		if op.TaskID != taskID || op.Kind == outboxDelete {
+			kept = append(kept, op)
+		}
+	}
+	h.Outbox = kept
+}
+
+// processOutbox executes all operations being due, all operations if force
+// is set. The outbox is saved first if it contains operations not saved yet.
+// While HabitRPG is unavailable the operations are kept queued.
+func (h *HabitTaskStore) processOutbox(force bool) error {
+	if !habiticaAvailable() {
+		return nil
+	}
+
+	h.outboxLock.Lock()
+	defer h.outboxLock.Unlock()
+
+	now := time.Now()
+	h.lock.RLock()
+	ops := []OutboxOperation{}
+	for _, op := range h.Outbox {
+		if force || !op.NextAttempt.After(now) {
+			ops = append(ops, op)
+		}
+	}
+	h.lock.RUnlock()
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	// enqueue marks the store changed before releasing the lock, so if the
+	// store is not dirty anymore all collected operations were saved
+	if h.isDirty() {
+		if err := h.Save(); err != nil {
+			return fmt.Errorf("Unable to save outbox: %s", err)
+		}
+	}
+
+	var err error
+	taskIDs := []string{}
+	for _, op := range ops {
+		taskIDs = append(taskIDs, op.TaskID)
+	}
+	// Created and completed todos change whether the tasks are waiting
+	defer rearmScheduler(h.accountID, taskIDs...)
+
+	for _, op := range ops {
+		if !habiticaAvailable() {
+			// Keep the remaining operations queued until HabitRPG recovers
+			break
+		}
+
+		todo, execErr := h.executeOperation(op)
+		if execErr != nil {
+			err = fmt.Errorf("Unable to %s todo for task %s: %s", op.Kind, op.TaskID, execErr)
+		}
+
+		h.lock.Lock()
+		event := h.recordOperation(op, todo, execErr)
+		h.lock.Unlock()
+		h.markChanged()
+
+		if event != nil {
+			publishEvent(*event)
+		}
+	}
+
+	return err
+}
+
+// executeOperation sends the operation to HabitRPG. For creates the todo is
+// returned, for scores the todo if it is completed now.
+func (h *HabitTaskStore) executeOperation(op OutboxOperation) (*habitrpg.Task, error) {
+	switch op.Kind {
+	case outboxCreate:
+		due := op.Due
+		if due.IsZero() {
+			due = op.Created
+		}
+		return h.createTodo(op.Alias, op.Text, due)
+
+	case outboxUpdate:
+		body, err := json.Marshal(map[string]string{"text": op.Text})
+		if err != nil {
+			return nil, err
+		}
+		err = h.doHTTPRequest("PUT", "application/json", "/tasks/"+url.PathEscape(op.TodoID), bytes.NewReader(body), nil)
+		if isNotFound(err) {
+			// Nothing left to update, UpdateStates handles the deletion
+			return nil, nil
+		}
+		return nil, err
+
+	case outboxDelete:
+		err := h.doHTTPRequest("DELETE", "application/json", "/tasks/"+url.PathEscape(op.TodoID), nil, nil)
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+
+	case outboxScore:
+		todo, err := h.fetchTodo(op.TodoID)
+		switch {
+		case err == errTodoNotFound:
+			return nil, nil
+		case err != nil:
+			return nil, err
+		case todo.Completed:
+			return todo, nil
+		}
+		if err := h.doHTTPRequest("POST", "application/json", "/tasks/"+url.PathEscape(op.TodoID)+"/score/up", nil, nil); err != nil {
+			return nil, err
+		}
+		todo.Completed = true
+		todo.DateCompleted = time.Now()
+		return todo, nil
+	}
+
+	return nil, fmt.Errorf("Unknown operation %q", op.Kind)
+}
+
+// recordOperation removes an executed operation from the outbox and records
+// its result on the task or schedules the next attempt if it failed. The
+// event to publish about the result is returned. The store must be locked by
+// the caller.
+func (h *HabitTaskStore) recordOperation(op OutboxOperation, todo *habitrpg.Task, err error) *Event {
+	idx := -1
+	for i := range h.Outbox {
+		if h.Outbox[i].ID == op.ID {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		// Dropped while being executed
+		return nil
+	}
+
+	if err == habitrpg.ErrCircuitOpen {
+		// Not sent at all, try again as soon as HabitRPG is available
+		return nil
+	}
+
+	if err != nil {
+		metricOutboxOperations.Inc(h.accountID, op.Kind, "error")
+		if op.Kind == outboxCreate {
+			metricTodosFailed.Inc(h.accountID)
+		}
+
+		pending := &h.Outbox[idx]
+		pending.Attempts++
+		pending.LastError = err.Error()
+		pending.NextAttempt = time.Now().Add(outboxRetryDelay(pending.Attempts))
+
+		e := newEvent(eventSyncFailed, h.accountID, h.task(op.TaskID), nil)
+		e.Error = fmt.Sprintf("Unable to %s todo: %s", op.Kind, err)
+		return &e
+	}
+
+	metricOutboxOperations.Inc(h.accountID, op.Kind, "success")
+	h.Outbox = append(h.Outbox[:idx], h.Outbox[idx+1:]...)
+
+	task := h.task(op.TaskID)
+
+	switch {
+	case op.Kind == outboxCreate && (task == nil || task.PendingCreate != op.ID):
+		log.Printf("Task %s changed while its todo was created, todo %s is not tracked", op.TaskID, todo.ID)
+
+	case op.Kind == outboxCreate:
+		task.LastTaskID = todo.ID
+		task.PendingCreate = ""
+		e := newEvent(eventOccurrenceCreated, h.accountID, task, todo)
+		return &e
+
+	case op.Kind == outboxScore && todo != nil && task != nil && task.LastTaskID == todo.ID && !task.IsCompleted:
+		now := time.Now()
+		h.addHistory(task, outcomeCompleted, now)
+		task.IsCompleted = true
+		task.LastTaskID = ""
+		task.LastCompletedDate = now
+		task.LastOutcome = outcomeCompleted
+		task.updateNextEntryTime(now, false)
+		e := newEvent(eventOccurrenceCompleted, h.accountID, task, todo)
+		return &e
+	}
+
+	return nil
+}
+
+// task returns the task with the given ID or nil if it does not exist. The
+// store must be locked by the caller.
+func (h *HabitTaskStore) task(id string) *HabitTask {
+	for i := range h.Tasks {
+		if h.Tasks[i].ID == id {
+			return &h.Tasks[i]
+		}
+	}
+	return nil
+}
+
+func outboxRetryDelay(attempts int) time.Duration {
+	delay := outboxRetryStart
+	for i := 1; i < attempts && delay < outboxRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > outboxRetryMax {
+		return outboxRetryMax
+	}
+	return delay
+}
+
+func isNotFound(err error) bool {
+	var statusErr habitrpg.StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// outboxWorker executes the outbox operations of all stores whenever new
+// operations were enqueued and periodically to retry failed ones
+type outboxWorker struct {
+	kick  chan struct{}
+	stop  chan struct{}
+	force atomic.Bool
+}
+
+var outbox = &outboxWorker{
+	kick: make(chan struct{}, 1),
+	stop: make(chan struct{}),
+}
+
+func (w *outboxWorker) notify() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+		// Processing is already pending
+	}
+}
+
+// retryNow executes all operations regardless of their next attempt
+func (w *outboxWorker) retryNow() {
+	w.force.Store(true)
+	w.notify()
+}
+
+func (w *outboxWorker) run(jobs *jobRunner) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.kick:
+		case <-ticker.C:
+		}
+
+		jobs.wrap(w.process)()
+	}
+}
+
+func (w *outboxWorker) process() {
+	force := w.force.Swap(false)
+	for _, store := range accounts.Stores() {
+		if !store.hasCredentials() {
+			continue
+		}
+		if err := store.processOutbox(force); err != nil {
+			log.Printf("An error ocurred while processing the outbox of account %s: %s", store.accountID, err)
+		}
+	}
+}
+
+// Stop ends the worker loop, operations left are executed after the next start
+func (w *outboxWorker) Stop() {
+	close(w.stop)
+}
+
+func handleGetOutbox(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) {
+	store.lock.RLock()
+	ops := append([]OutboxOperation{}, store.Outbox...)
+	store.lock.RUnlock()
+
+	data, _ := json.Marshal(ops)
+
+	res.Header().Add("Content-Type", "application/json")
+	res.Write(data)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Luzifer/habitscheduler/habitrpg"
+)
+
+func TestOutboxReplayAfterReload(t *testing.T) {
+	f := newFakeHabitica(t)
+	dir := t.TempDir()
+
+	store := newTestStore(t, f, dir)
+	store.Tasks = []HabitTask{dueTestTask("a", "Water plants")}
+
+	// The operation is saved before it is executed, HabitRPG fails
+	f.fail = http.StatusServiceUnavailable
+	if _, err := store.createDueTasks(nil); err == nil {
+		t.Fatal("Creating the todo did not fail")
+	}
+	f.fail = 0
+
+	reloaded := newTestStore(t, f, dir)
+	if len(reloaded.Outbox) != 1 || reloaded.Outbox[0].Kind != outboxCreate {
+		t.Fatalf("Queued creation was not persisted: %+v", reloaded.Outbox)
+	}
+	if reloaded.Tasks[0].PendingCreate != reloaded.Outbox[0].ID {
+		t.Fatalf("Task does not reference the queued creation: %+v", reloaded.Tasks[0])
+	}
+
+	if err := reloaded.processOutbox(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := f.openTodos(); !reflect.DeepEqual(got, []string{"Water plants"}) {
+		t.Errorf("Unexpected open todos in HabitRPG: %v", got)
+	}
+	task := reloaded.Tasks[0]
+	if task.LastTaskID == "" || task.PendingCreate != "" || len(reloaded.Outbox) != 0 {
+		t.Errorf("Result of the replayed creation was not recorded: %+v, outbox %+v", task, reloaded.Outbox)
+	}
+}
+
+func TestOutboxCreateAdoptsTodoByAlias(t *testing.T) {
+	f := newFakeHabitica(t)
+	dir := t.TempDir()
+
+	store := newTestStore(t, f, dir)
+	store.Tasks = []HabitTask{dueTestTask("a", "Water plants")}
+
+	f.fail = http.StatusServiceUnavailable
+	store.createDueTasks(nil)
+	f.fail = 0
+
+	// The todo was created but the process died before recording it
+	op := store.Outbox[0]
+	existing, err := store.createTodo(op.Alias, op.Text, op.Due)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.lock.Lock()
+	f.requests = nil
+	f.lock.Unlock()
+
+	reloaded := newTestStore(t, f, dir)
+	if err := reloaded.processOutbox(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := f.openTodos(); len(got) != 1 {
+		t.Errorf("Expected the existing todo only, got %v", got)
+	}
+	for _, r := range f.requests {
+		if r == "POST /tasks/user" {
+			t.Errorf("Todo was created again")
+		}
+	}
+	if task := reloaded.Tasks[0]; task.LastTaskID != existing.ID || len(reloaded.Outbox) != 0 {
+		t.Errorf("Existing todo %s was not adopted: %+v", existing.ID, task)
+	}
+}
+
+func TestOutboxDropOperations(t *testing.T) {
+	f := newFakeHabitica(t)
+	store := newTestStore(t, f, t.TempDir())
+	store.Tasks = []HabitTask{dueTestTask("a", "Water plants"), dueTestTask("b", "Feed cat")}
+
+	f.fail = http.StatusServiceUnavailable
+	store.createDueTasks(nil)
+
+	store.lock.Lock()
+	store.enqueue(OutboxOperation{Kind: outboxDelete, TaskID: "a", TodoID: "todo-a"})
+	store.enqueue(OutboxOperation{Kind: outboxScore, TaskID: "a", TodoID: "todo-a"})
+	store.dropOperations("a")
+	kinds := []string{}
+	for _, op := range store.Outbox {
+		kinds = append(kinds, op.TaskID+":"+op.Kind)
+	}
+	store.lock.Unlock()
+
+	if expected := []string{"b:create", "a:delete"}; !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Expected operations %v to be kept, got %v", expected, kinds)
+	}
+}
+
+func TestRecordOperation(t *testing.T) {
+	todo := &habitrpg.Task{ID: "todo", Completed: true}
+
+	for _, c := range []struct {
+		name    string
+		task    HabitTask
+		op      OutboxOperation
+		err     error
+		event   string
+		outbox  int
+		check   func(HabitTask) error
+		retried bool
+	}{
+		{
+			name:   "created",
+			task:   HabitTask{ID: "a", PendingCreate: "op"},
+			op:     OutboxOperation{ID: "op", Kind: outboxCreate, TaskID: "a"},
+			event:  eventOccurrenceCreated,
+			outbox: 0,
+			check: func(t HabitTask) error {
+				if t.LastTaskID != "todo" || t.PendingCreate != "" {
+					return fmt.Errorf("todo not recorded")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "created for changed task",
+			task:   HabitTask{ID: "a", PendingCreate: "other"},
+			op:     OutboxOperation{ID: "op", Kind: outboxCreate, TaskID: "a"},
+			outbox: 0,
+			check: func(t HabitTask) error {
+				if t.LastTaskID != "" || t.PendingCreate != "other" {
+					return fmt.Errorf("untracked todo was recorded")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "completed",
+			task:   HabitTask{ID: "a", LastTaskID: "todo", RepeatHours: 24},
+			op:     OutboxOperation{ID: "op", Kind: outboxScore, TaskID: "a", TodoID: "todo"},
+			event:  eventOccurrenceCompleted,
+			outbox: 0,
+			check: func(t HabitTask) error {
+				if !t.IsCompleted || t.LastTaskID != "" || t.LastOutcome != outcomeCompleted {
+					return fmt.Errorf("completion not recorded")
+				}
+				return nil
+			},
+		},
+		{
+			name:    "failed",
+			task:    HabitTask{ID: "a", PendingCreate: "op"},
+			op:      OutboxOperation{ID: "op", Kind: outboxCreate, TaskID: "a"},
+			err:     habitrpg.StatusError{StatusCode: http.StatusInternalServerError},
+			event:   eventSyncFailed,
+			outbox:  1,
+			retried: true,
+		},
+		{
+			name:   "circuit open",
+			task:   HabitTask{ID: "a", PendingCreate: "op"},
+			op:     OutboxOperation{ID: "op", Kind: outboxCreate, TaskID: "a"},
+			err:    habitrpg.ErrCircuitOpen,
+			outbox: 1,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			store := &HabitTaskStore{accountID: defaultAccountID, Tasks: []HabitTask{c.task}, Outbox: []OutboxOperation{c.op}}
+
+			result := todo
+			if c.op.Kind == outboxCreate {
+				result = &habitrpg.Task{ID: "todo"}
+			}
+			event := store.recordOperation(c.op, result, c.err)
+
+			switch {
+			case c.event == "" && event != nil:
+				t.Errorf("Unexpected event %s", event.Type)
+			case c.event != "" && (event == nil || event.Type != c.event):
+				t.Errorf("Expected event %s, got %+v", c.event, event)
+			}
+			if len(store.Outbox) != c.outbox {
+				t.Fatalf("Expected %d operations left, got %d", c.outbox, len(store.Outbox))
+			}
+			if c.retried {
+				op := store.Outbox[0]
+				if op.Attempts != 1 || !strings.Contains(op.LastError, "500") || !op.NextAttempt.After(time.Now()) {
+					t.Errorf("Failed operation not scheduled for retry: %+v", op)
+				}
+			}
+			if c.check != nil {
+				if err := c.check(store.Tasks[0]); err != nil {
+					t.Errorf("Task %+v: %s", store.Tasks[0], err)
+				}
+			}
+		})
+	}
+
+	// Operations dropped while being executed are ignored
+	store := &HabitTaskStore{accountID: defaultAccountID, Tasks: []HabitTask{{ID: "a"}}}
+	if event := store.recordOperation(OutboxOperation{ID: "op", Kind: outboxCreate, TaskID: "a"}, todo, nil); event != nil {
+		t.Errorf("Event published for dropped operation: %s", event.Type)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	retryBackoffStart = time.Second
+	retryBackoffMax   = time.Minute
+)
+
+// storeReady is set as soon as the accounts were loaded from Redis. Before
+// that redisConnection and accounts must not be used.
+var storeReady atomic.Bool
+
+// connectStore loads the store, retrying with backoff as long as Redis is
+// not reachable. Other errors (like undecryptable or too new data) are fatal.
+func connectStore() {
+	backoff := retryBackoffStart
+	for {
+		err := openStore()
+		if err == nil {
+			break
+		}
+
+		if !isConnectionError(err) {
+			log.Printf("Error while loading HabitRPG store: %s", err)
+			os.Exit(1)
+		}
+
+		log.Printf("Error while loading HabitRPG store: %s, retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+
+	storeReady.Store(true)
+	resyncScheduler()
+	log.Printf("Store loaded from %s storage", dataStorage.Name())
+}
+
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func nextBackoff(current time.Duration) time.Duration {
+	if current *= 2; current > retryBackoffMax {
+		return retryBackoffMax
+	}
+	return current
+}
+
+// requireStore rejects requests while the store is not loaded
+func requireStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if !storeReady.Load() {
+			res.Header().Set("Retry-After", "5")
+			http.Error(res, "Store is not loaded yet", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(res, r)
+	})
+}
+
+// persistState tracks since when saving the state keeps failing
+type persistState struct {
+	lock         sync.Mutex
+	failingSince time.Time
+	lastError    string
+	alerted      bool
+}
+
+var persistence = &persistState{}
+
+func (p *persistState) record(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err == nil {
+		metricPersist.Inc("success")
+		if p.alerted {
+			log.Printf("Saving to Redis recovered after failing for %s", time.Since(p.failingSince).Truncate(time.Second))
+		}
+		p.failingSince = time.Time{}
+		p.lastError = ""
+		p.alerted = false
+		return
+	}
+
+	metricPersist.Inc("error")
+	if p.failingSince.IsZero() {
+		p.failingSince = time.Now()
+	}
+	p.lastError = err.Error()
+
+	if !p.alerted && time.Since(p.failingSince) > config.PersistAlertAfter {
+		log.Printf("ALERT: Saving to Redis has been failing for %s, changes since then only exist in memory: %s",
+			time.Since(p.failingSince).Truncate(time.Second), err)
+		p.alerted = true
+	}
+}
+
+// FailingFor returns how long saving has been failing, 0 if the last save
+// succeeded
+func (p *persistState) FailingFor() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.failingSince.IsZero() {
+		return 0
+	}
+	return time.Since(p.failingSince)
+}
+
+func (p *persistState) LastError() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.lastError
+}
+
+// saveWithRetry saves all accounts, retrying with backoff until it succeeds
+// or the context is cancelled. The in-memory state is never discarded.
+func saveWithRetry(ctx context.Context) error {
+	backoff := retryBackoffStart
+	for {
+		err := accounts.SaveAll()
+		persistence.record(err)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// commitTimeout limits how long a request waits for its change to be saved
+const commitTimeout = 10 * time.Second
+
+// writeBehind saves stores shortly after they were changed. Changes made
+// within --persist-debounce are saved together.
+type writeBehind struct {
+	kick chan struct{}
+}
+
+var writer = &writeBehind{kick: make(chan struct{}, 1)}
+
+// notify schedules a save of the changed stores
+func (w *writeBehind) notify() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+		// A save is already pending
+	}
+}
+
+func (w *writeBehind) run() {
+	backoff := retryBackoffStart
+	for range w.kick {
+		time.Sleep(config.PersistDebounce)
+
+		if err := w.flush(); err != nil {
+			log.Printf("Unable to save changes to Redis: %s, retrying in %s", err, backoff)
+			time.AfterFunc(backoff, w.notify)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = retryBackoffStart
+	}
+}
+
+// flush saves all stores having unsaved changes
+func (w *writeBehind) flush() error {
+	if !storeReady.Load() || !isLeader() {
+		return nil
+	}
+
+	var (
+		err   error
+		saved bool
+	)
+	for _, store := range accounts.Stores() {
+		if !store.isDirty() {
+			continue
+		}
+
+		saved = true
+		if serr := store.Save(); serr != nil {
+			err = fmt.Errorf("Unable to save account %s: %s", store.accountID, serr)
+		}
+	}
+
+	if saved {
+		persistence.record(err)
+	}
+	return err
+}
+
+// commitChange marks the store as changed and waits for the change to be
+// saved. If saving fails the client gets a 503 and false is returned, the
+// change is kept in memory and saved as soon as Redis works again.
+func commitChange(store *HabitTaskStore, res http.ResponseWriter, r *http.Request) bool {
+	changes := store.markChanged()
+
+	ctx, cancel := context.WithTimeout(r.Context(), commitTimeout)
+	defer cancel()
+
+	if err := store.waitSaved(ctx, changes); err != nil {
+		msg := "Change was applied but could not be saved yet, it is retried in the background"
+		if last := persistence.LastError(); last != "" {
+			msg += ": " + last
+		}
+		res.Header().Set("Retry-After", "5")
+		http.Error(res, msg, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
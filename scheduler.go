@@ -0,0 +1,369 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// schedulerMaxSleep limits how long the scheduler sleeps without checking
+	// the tasks again, entry dates are wall clock times which might jump
+	schedulerMaxSleep = 10 * time.Minute
+	// schedulerRetryDelay is the time to wait before creating a todo again
+	// after creating it failed
+	schedulerRetryDelay = time.Minute
+)
+
+// dueEntry is a waiting task in the queue of the scheduler
+type dueEntry struct {
+	due       time.Time
+	accountID string
+	taskID    string
+	index     int // Position in the heap, maintained by dueQueue
+}
+
+// dueQueue orders the waiting tasks by their due time, earliest first
+type dueQueue []*dueEntry
+
+func (q dueQueue) Len() int           { return len(q) }
+func (q dueQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q dueQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *dueQueue) Push(x interface{}) {
+	e := x.(*dueEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *dueQueue) Pop() interface{} {
+	old := *q
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	last.index = -1
+	*q = old[:len(old)-1]
+	return last
+}
+
+// dueScheduler sleeps until the next task is due and creates its todo right
+// away. The waiting tasks are kept in a queue ordered by their entry date
+// which is updated in place for the tasks passed to rearmScheduler, only
+// resyncScheduler rebuilds it from all tasks. The --cron-create job does so
+// as a safety sweep.
+type dueScheduler struct {
+	rearm chan struct{}
+	stop  chan struct{}
+
+	// changed collects the tasks to update in the queue by account, a nil
+	// set updates all tasks of the account
+	lock    sync.Mutex
+	changed map[string]map[string]bool
+	resync  bool
+
+	// Only accessed by the scheduler loop: the queue, its entries by
+	// account and task ID and the delays of tasks whose todo could not be
+	// created
+	queue   dueQueue
+	entries map[string]*dueEntry
+	retryAt map[string]time.Time
+}
+
+// scheduler is nil outside of the server, the re-arm functions are safe to
+// call anyway
+var scheduler *dueScheduler
+
+func newDueScheduler() *dueScheduler {
+	return &dueScheduler{
+		rearm:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		changed: map[string]map[string]bool{},
+		resync:  true,
+		entries: map[string]*dueEntry{},
+		retryAt: map[string]time.Time{},
+	}
+}
+
+// rearmScheduler updates the given tasks in the queue of the scheduler, it
+// needs to be called after tasks were created, changed or completed
+func rearmScheduler(accountID string, taskIDs ...string) {
+	if scheduler == nil || len(taskIDs) == 0 {
+		return
+	}
+
+	scheduler.lock.Lock()
+	tasks, ok := scheduler.changed[accountID]
+	if !ok || tasks != nil {
+		if tasks == nil {
+			tasks = map[string]bool{}
+			scheduler.changed[accountID] = tasks
+		}
+		for _, id := range taskIDs {
+			tasks[id] = true
+		}
+	}
+	scheduler.lock.Unlock()
+
+	scheduler.wake()
+}
+
+// rearmSchedulerAccount updates all tasks of the account in the queue of the
+// scheduler, used when an account or its credentials were changed or all of
+// its tasks were replaced
+func rearmSchedulerAccount(accountID string) {
+	if scheduler == nil {
+		return
+	}
+
+	scheduler.lock.Lock()
+	scheduler.changed[accountID] = nil
+	scheduler.lock.Unlock()
+
+	scheduler.wake()
+}
+
+// resyncScheduler rebuilds the queue of the scheduler from all tasks, used
+// after the state was loaded and by the safety sweep
+func resyncScheduler() {
+	if scheduler == nil {
+		return
+	}
+
+	scheduler.lock.Lock()
+	scheduler.resync = true
+	scheduler.changed = map[string]map[string]bool{}
+	scheduler.lock.Unlock()
+
+	scheduler.wake()
+}
+
+func (s *dueScheduler) wake() {
+	select {
+	case s.rearm <- struct{}{}:
+	default:
+		// A re-arm is already pending
+	}
+}
+
+func (s *dueScheduler) run(jobs *jobRunner) {
+	for {
+		var (
+			timer *time.Timer
+			wake  <-chan time.Time
+		)
+		if d, ok := s.nextWake(); ok {
+			timer = time.NewTimer(d)
+			wake = timer.C
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.rearm:
+		case <-wake:
+			jobs.wrap(s.createDue)()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Stop ends the scheduler loop
+func (s *dueScheduler) Stop() {
+	close(s.stop)
+}
+
+// update applies the changes collected by the re-arm functions to the queue
+func (s *dueScheduler) update() {
+	s.lock.Lock()
+	resync, changed := s.resync, s.changed
+	s.resync, s.changed = false, map[string]map[string]bool{}
+	s.lock.Unlock()
+
+	if resync {
+		s.rebuild()
+		return
+	}
+
+	for accountID, tasks := range changed {
+		store := accounts.Store(accountID)
+		if tasks == nil {
+			s.refreshAccount(accountID, store)
+			continue
+		}
+		for taskID := range tasks {
+			s.refresh(accountID, store, taskID)
+		}
+	}
+}
+
+// rebuild fills the queue with the waiting tasks of all accounts having
+// credentials
+func (s *dueScheduler) rebuild() {
+	now := time.Now()
+	for key, retry := range s.retryAt {
+		if retry.Before(now) {
+			delete(s.retryAt, key)
+		}
+	}
+
+	s.queue = dueQueue{}
+	s.entries = map[string]*dueEntry{}
+	for _, store := range accounts.Stores() {
+		s.addAccount(store)
+	}
+	heap.Init(&s.queue)
+}
+
+// refreshAccount replaces the entries of the account, store is nil if the
+// account was removed
+func (s *dueScheduler) refreshAccount(accountID string, store *HabitTaskStore) {
+	for key, e := range s.entries {
+		if e.accountID == accountID {
+			heap.Remove(&s.queue, e.index)
+			delete(s.entries, key)
+		}
+	}
+
+	if store != nil {
+		s.addAccount(store)
+	}
+}
+
+func (s *dueScheduler) addAccount(store *HabitTaskStore) {
+	if !store.hasCredentials() {
+		return
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for _, t := range store.Tasks {
+		if due, ok := s.dueTime(store.accountID, t); ok {
+			s.set(store.accountID, t.ID, due, true)
+		}
+	}
+}
+
+// refresh updates the entry of a single task, removing it if the task is
+// not waiting anymore
+func (s *dueScheduler) refresh(accountID string, store *HabitTaskStore, taskID string) {
+	var (
+		due     time.Time
+		waiting bool
+	)
+	if store != nil && store.hasCredentials() {
+		store.lock.RLock()
+		if t := store.task(taskID); t != nil {
+			due, waiting = s.dueTime(accountID, *t)
+		}
+		store.lock.RUnlock()
+	}
+
+	s.set(accountID, taskID, due, waiting)
+}
+
+// dueTime returns when the todo of the task has to be created, false if the
+// task is not waiting for its next occurrence
+func (s *dueScheduler) dueTime(accountID string, t HabitTask) (time.Time, bool) {
+	if !t.IsCompleted || t.IsPaused {
+		return time.Time{}, false
+	}
+
+	due := t.NextEntryDate
+	if retry, ok := s.retryAt[accountID+"/"+t.ID]; ok && retry.After(due) {
+		due = retry
+	}
+	return due, true
+}
+
+func (s *dueScheduler) set(accountID, taskID string, due time.Time, waiting bool) {
+	key := accountID + "/" + taskID
+	e, queued := s.entries[key]
+
+	switch {
+	case queued && !waiting:
+		heap.Remove(&s.queue, e.index)
+		delete(s.entries, key)
+	case queued:
+		e.due = due
+		heap.Fix(&s.queue, e.index)
+	case waiting:
+		e = &dueEntry{due: due, accountID: accountID, taskID: taskID}
+		heap.Push(&s.queue, e)
+		s.entries[key] = e
+	}
+}
+
+// nextWake returns how long to sleep until the next task is due. While the
+// store is not loaded or this instance is not the leader the scheduler only
+// waits to be re-armed and rebuilds the queue afterwards.
+func (s *dueScheduler) nextWake() (time.Duration, bool) {
+	if !storeReady.Load() || !isLeader() {
+		s.lock.Lock()
+		s.resync = true
+		s.lock.Unlock()
+		return 0, false
+	}
+
+	s.update()
+	if s.queue.Len() == 0 {
+		return schedulerMaxSleep, true
+	}
+
+	d := time.Until(s.queue[0].due)
+	switch {
+	case d < 0:
+		return 0, true
+	case d > schedulerMaxSleep:
+		return schedulerMaxSleep, true
+	}
+	return d, true
+}
+
+// createDue creates the todos of all tasks being due now
+func (s *dueScheduler) createDue() {
+	now := time.Now()
+	s.update()
+
+	due := map[string][]string{}
+	for s.queue.Len() > 0 && !s.queue[0].due.After(now) {
+		e := heap.Pop(&s.queue).(*dueEntry)
+		delete(s.entries, e.accountID+"/"+e.taskID)
+		due[e.accountID] = append(due[e.accountID], e.taskID)
+	}
+
+	for accountID, taskIDs := range due {
+		store := accounts.Store(accountID)
+		if store == nil {
+			continue
+		}
+
+		created, err := store.createDueTasks(taskIDs)
+		if err != nil {
+			log.Printf("An error ocurred while creating tasks for account %s: %s", accountID, err)
+		}
+
+		done := map[string]bool{}
+		for _, id := range created {
+			done[id] = true
+		}
+		for _, id := range taskIDs {
+			if done[id] {
+				delete(s.retryAt, accountID+"/"+id)
+			} else {
+				s.retryAt[accountID+"/"+id] = now.Add(schedulerRetryDelay)
+			}
+			// Tasks whose todo could not be created are queued again with
+			// their retry delay
+			s.refresh(accountID, store, id)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"container/heap"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queueOrder pops all entries and returns their task IDs in due order,
+// checking the heap positions stored in the entries on the way
+func queueOrder(t *testing.T, s *dueScheduler) string {
+	t.Helper()
+
+	for i, e := range s.queue {
+		if e.index != i {
+			t.Fatalf("Entry %s has index %d at position %d", e.taskID, e.index, i)
+		}
+		if s.entries[e.accountID+"/"+e.taskID] != e {
+			t.Fatalf("Entry %s is not indexed", e.taskID)
+		}
+	}
+	if len(s.entries) != s.queue.Len() {
+		t.Fatalf("%d indexed entries for %d queued", len(s.entries), s.queue.Len())
+	}
+
+	q := dueQueue{}
+	for _, e := range s.queue {
+		c := *e
+		q = append(q, &c)
+	}
+	ids := []string{}
+	for q.Len() > 0 {
+		ids = append(ids, heap.Pop(&q).(*dueEntry).taskID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestDueQueueUpdatesInPlace(t *testing.T) {
+	s := newDueScheduler()
+	base := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+
+	for i, id := range []string{"a", "b", "c", "d"} {
+		s.set("default", id, base.Add(time.Duration(i)*time.Hour), true)
+	}
+	if got := queueOrder(t, s); got != "a,b,c,d" {
+		t.Fatalf("Unexpected order %s", got)
+	}
+
+	// Moving an entry keeps a single entry for the task
+	s.set("default", "d", base.Add(-time.Hour), true)
+	s.set("default", "a", base.Add(10*time.Hour), true)
+	if got := queueOrder(t, s); got != "d,b,c,a" {
+		t.Errorf("Unexpected order after update %s", got)
+	}
+
+	// Tasks not waiting anymore are removed, unknown ones ignored
+	s.set("default", "b", time.Time{}, false)
+	s.set("default", "x", time.Time{}, false)
+	if got := queueOrder(t, s); got != "d,c,a" {
+		t.Errorf("Unexpected order after removal %s", got)
+	}
+
+	// The same task ID in another account is a separate entry
+	s.set("other", "c", base, true)
+	if got := queueOrder(t, s); got != "d,c,c,a" {
+		t.Errorf("Unexpected order with second account %s", got)
+	}
+}
+
+func TestDueTimeRetry(t *testing.T) {
+	s := newDueScheduler()
+	due := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	task := HabitTask{ID: "a", IsCompleted: true, NextEntryDate: due}
+
+	if got, ok := s.dueTime("default", task); !ok || !got.Equal(due) {
+		t.Errorf("Waiting task due at %s (%v), want %s", got, ok, due)
+	}
+
+	s.retryAt["default/a"] = due.Add(time.Minute)
+	if got, _ := s.dueTime("default", task); !got.Equal(due.Add(time.Minute)) {
+		t.Errorf("Retry delay not applied: %s", got)
+	}
+
+	for name, task := range map[string]HabitTask{
+		"open":   {ID: "a", NextEntryDate: due},
+		"paused": {ID: "a", IsCompleted: true, IsPaused: true, NextEntryDate: due},
+	} {
+		if _, ok := s.dueTime("default", task); ok {
+			t.Errorf("%s task is queued", name)
+		}
+	}
+}
+
+func TestRearmSchedulerCollectsChanges(t *testing.T) {
+	saved := scheduler
+	defer func() { scheduler = saved }()
+
+	scheduler = newDueScheduler()
+	scheduler.resync = false
+
+	rearmScheduler("default", "a", "b")
+	rearmScheduler("default", "b", "c")
+	rearmScheduler("default")
+	rearmSchedulerAccount("alice")
+	rearmScheduler("alice", "x")
+
+	if got := len(scheduler.changed["default"]); got != 3 {
+		t.Errorf("Expected 3 changed tasks, got %d", got)
+	}
+	if tasks, ok := scheduler.changed["alice"]; !ok || tasks != nil {
+		t.Errorf("Account refresh was replaced by single tasks: %v", tasks)
+	}
+
+	resyncScheduler()
+	if !scheduler.resync || len(scheduler.changed) != 0 {
+		t.Errorf("Resync did not replace the collected changes")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/robfig/cron"
+)
+
+// jobRunner tracks the cron jobs currently running so the shutdown can wait
+// for them and prevents new jobs from starting once the shutdown began or
+// while the store is not yet loaded or this instance is not the leader
+type jobRunner struct {
+	running  sync.WaitGroup
+	lock     sync.Mutex
+	stopping bool
+}
+
+func (j *jobRunner) wrap(job func()) func() {
+	return func() {
+		if !storeReady.Load() || !isLeader() {
+			return
+		}
+
+		j.lock.Lock()
+		if j.stopping {
+			j.lock.Unlock()
+			return
+		}
+		j.running.Add(1)
+		j.lock.Unlock()
+
+		defer j.running.Done()
+		job()
+	}
+}
+
+// stop prevents new jobs from starting and waits for the running ones to
+// finish or the context to be cancelled
+func (j *jobRunner) stop(ctx context.Context) error {
+	j.lock.Lock()
+	j.stopping = true
+	j.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		j.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Jobs still running: %s", ctx.Err())
+	}
+}
+
+// shutdown stops accepting API requests and waits for running requests and
+// jobs to finish within the --shutdown-timeout before storing the final state.
+// The state is saved even if the timeout was hit. The leader lease is released
+// afterwards so another replica can take over.
+func shutdown(srv *http.Server, c *cron.Cron, jobs *jobRunner) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	var errs []error
+
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("API requests still running: %s", err))
+	}
+
+	c.Stop()
+	if scheduler != nil {
+		scheduler.Stop()
+	}
+	outbox.Stop()
+	if webhooks != nil {
+		webhooks.Stop()
+	}
+	if err := jobs.stop(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if mailer != nil {
+		// Send the notifications of the last jobs and a pending digest
+		mailer.Stop()
+	}
+	if mqttClient != nil {
+		// Send the events of the last jobs
+		mqttClient.Stop()
+	}
+
+	if storeReady.Load() && isLeader() {
+		if err := saveWithRetry(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("Final save failed: %s", err))
+		}
+	}
+
+	if leadership != nil {
+		leadership.Stop()
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/xuyu/goredis"
+)
+
+const (
+	storageRedis   = "redis"
+	storageJournal = "journal"
+)
+
+// storage persists the account registry and the task stores as documents
+// identified by keys derived from --redis-key. Get returns nil for keys
+// which were never written.
+type storage interface {
+	Name() string
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Del(key string) error
+	Ping() error
+	Close()
+}
+
+// dataStorage is set together with accounts once the store is loaded
+var dataStorage storage
+
+func openStorage() (storage, error) {
+	switch config.Storage {
+	case storageRedis:
+		conn, err := goredis.DialURL(config.RedisAddress)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to Redis: %w", err)
+		}
+		return redisStorage{conn}, nil
+
+	case storageJournal:
+		return openJournalStorage(config.JournalDir)
+
+	default:
+		return nil, fmt.Errorf("Unknown storage %q, use %s or %s", config.Storage, storageRedis, storageJournal)
+	}
+}
+
+// redisStorage keeps every document in its own Redis key, writes are fenced
+// when leader election is enabled
+type redisStorage struct {
+	conn *goredis.Redis
+}
+
+func (s redisStorage) Name() string { return storageRedis }
+
+func (s redisStorage) Get(key string) ([]byte, error) {
+	return s.conn.Get(key)
+}
+
+func (s redisStorage) Set(key string, value []byte) error {
+	return redisSet(s.conn, key, string(value))
+}
+
+func (s redisStorage) Del(key string) error {
+	return redisDel(s.conn, key)
+}
+
+func (s redisStorage) Ping() error {
+	return s.conn.Ping()
+}
+
+func (s redisStorage) Close() {
+	s.conn.ClosePool()
+}
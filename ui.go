@@ -0,0 +1,21 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiAssets embed.FS
+
+// uiHandler serves the embedded web UI
+func uiHandler() http.Handler {
+	assets, err := fs.Sub(uiAssets, "ui")
+	if err != nil {
+		// Can only happen if the embed directive above is broken
+		panic(err)
+	}
+
+	return http.FileServer(http.FS(assets))
+}
@@ -0,0 +1,215 @@
+(function () {
+  'use strict';
+
+  var form = document.getElementById('task-form');
+  var previewTimer = null;
+
+  function askToken() {
+    var token = window.prompt('API token', window.localStorage.getItem('token') || '');
+    if (token === null) {
+      return false;
+    }
+    window.localStorage.setItem('token', token.trim());
+    return true;
+  }
+
+  function api(method, path, body, retried) {
+    var opts = { method: method, headers: {} };
+    if (body !== undefined) {
+      opts.headers['Content-Type'] = 'application/json';
+      opts.body = JSON.stringify(body);
+    }
+    if (window.localStorage.getItem('token')) {
+      opts.headers.Authorization = 'Bearer ' + window.localStorage.getItem('token');
+    }
+
+    return fetch('v1' + path, opts).then(function (res) {
+      if (res.status === 401 && !retried && askToken()) {
+        return api(method, path, body, true);
+      }
+      if (!res.ok) {
+        return res.text().then(function (msg) {
+          var err = new Error(msg.trim() || res.statusText);
+          err.status = res.status;
+          throw err;
+        });
+      }
+      var type = res.headers.get('Content-Type') || '';
+      return type.indexOf('application/json') === 0 ? res.json() : res.text();
+    });
+  }
+
+  function showError(id, err) {
+    var el = document.getElementById(id);
+    el.hidden = !err;
+    el.textContent = err ? err.message : '';
+  }
+
+  function formatDate(value) {
+    return new Date(value).toLocaleString();
+  }
+
+  function schedule(task) {
+    var parts = [];
+    if (task.RepeatHours > 0) {
+      parts.push(task.RepeatHours + 'h after completion');
+    }
+    if (task.RepeatCron) {
+      parts.push('cron "' + task.RepeatCronEntry + '"');
+    }
+    return parts.join(', ');
+  }
+
+  function state(task) {
+    if (task.IsPaused) {
+      return 'paused';
+    }
+    return task.IsCompleted ? 'waiting' : 'open';
+  }
+
+  function button(label, handler) {
+    var btn = document.createElement('button');
+    btn.type = 'button';
+    btn.textContent = label;
+    btn.addEventListener('click', handler);
+    return btn;
+  }
+
+  function action(method, path) {
+    return function () {
+      api(method, path).then(load).catch(function (err) { showError('error', err); });
+    };
+  }
+
+  function render(tasks) {
+    var tbody = document.querySelector('#tasks tbody');
+    tbody.innerHTML = '';
+
+    tasks.sort(function (a, b) {
+      return new Date(a.NextEntryDate) - new Date(b.NextEntryDate);
+    });
+
+    tasks.forEach(function (task) {
+      var tr = document.createElement('tr');
+      tr.className = state(task);
+
+      [task.Title, schedule(task), formatDate(task.NextEntryDate), state(task)].forEach(function (text) {
+        var td = document.createElement('td');
+        td.textContent = text;
+        tr.appendChild(td);
+      });
+
+      var actions = document.createElement('td');
+      actions.className = 'actions';
+      actions.appendChild(button('Edit', function () { edit(task); }));
+      actions.appendChild(button('Trigger', action('POST', '/tasks/' + task.ID + '/trigger')));
+      if (!task.IsCompleted && task.LastTaskID) {
+        actions.appendChild(button('Complete', action('POST', '/tasks/' + task.ID + '/complete')));
+      }
+      actions.appendChild(task.IsPaused ?
+        button('Resume', action('POST', '/tasks/' + task.ID + '/resume')) :
+        button('Pause', action('POST', '/tasks/' + task.ID + '/pause')));
+      actions.appendChild(button('Delete', function () {
+        if (window.confirm('Delete "' + task.Title + '"?')) {
+          action('DELETE', '/tasks/' + task.ID)();
+        }
+      }));
+      tr.appendChild(actions);
+
+      tbody.appendChild(tr);
+    });
+  }
+
+  function load() {
+    return api('GET', '/tasks').then(function (tasks) {
+      showError('error', null);
+      render(tasks || []);
+    }).catch(function (err) { showError('error', err); });
+  }
+
+  function formTask() {
+    var cron = form.cron.value.trim();
+    return {
+      Title: form.title.value,
+      RepeatHours: parseInt(form.hours.value, 10) || 0,
+      RepeatCron: cron !== '',
+      RepeatCronEntry: cron,
+      OnDelete: form.ondelete.value,
+      OverdueHours: parseInt(form.overduehours.value, 10) || 0,
+      NotifyEmails: form.notifyemails.value.split(',').map(function (e) { return e.trim(); }).filter(Boolean),
+      NotifyOn: form.notifyon.value.split(','),
+      LinkTodo: form.link.value.trim(),
+      LinkTodoText: form.linktext.value.trim()
+    };
+  }
+
+  function save(task) {
+    var id = form.id.value;
+    var req = id ? api('PUT', '/tasks/' + id, task) : api('POST', '/tasks', task);
+    return req.catch(function (err) {
+      // A todo found by its text has to be confirmed before it is linked
+      if (err.status === 409 && task.LinkTodoText && !task.ConfirmLink && window.confirm(err.message)) {
+        task.ConfirmLink = true;
+        return save(task);
+      }
+      throw err;
+    });
+  }
+
+  function edit(task) {
+    form.id.value = task.ID;
+    form.title.value = task.Title;
+    form.hours.value = task.RepeatHours;
+    form.cron.value = task.RepeatCron ? task.RepeatCronEntry : '';
+    form.ondelete.value = task.OnDelete || 'skip';
+    form.overduehours.value = task.OverdueHours || 0;
+    form.notifyemails.value = (task.NotifyEmails || []).join(', ');
+    form.notifyon.value = (task.NotifyOn || ['created', 'overdue']).join(',');
+    document.getElementById('form-title').textContent = 'Edit task';
+    preview();
+  }
+
+  function reset() {
+    form.reset();
+    form.id.value = '';
+    document.getElementById('form-title').textContent = 'New task';
+    preview();
+  }
+
+  function preview() {
+    window.clearTimeout(previewTimer);
+    previewTimer = window.setTimeout(function () {
+      var list = document.getElementById('preview');
+      list.innerHTML = '';
+
+      api('POST', '/schedule/preview?count=5', formTask()).then(function (dates) {
+        showError('preview-error', null);
+        dates.forEach(function (date) {
+          var li = document.createElement('li');
+          li.textContent = formatDate(date);
+          list.appendChild(li);
+        });
+      }).catch(function (err) { showError('preview-error', err); });
+    }, 300);
+  }
+
+  form.addEventListener('input', preview);
+  form.addEventListener('submit', function (evt) {
+    evt.preventDefault();
+
+    save(formTask()).then(function () {
+      reset();
+      return load();
+    }).catch(function (err) { showError('preview-error', err); });
+  });
+
+  document.getElementById('cancel').addEventListener('click', reset);
+  document.getElementById('refresh').addEventListener('click', load);
+  document.getElementById('token').addEventListener('click', function () {
+    if (askToken()) {
+      load();
+    }
+  });
+
+  load();
+})();
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Webhooks receive the events as JSON documents in POST requests. Deliveries
+// are kept in memory only: deliveries waiting for a retry are lost when the
+// process stops.
+
+const (
+	deliveryPending   = "pending"   // Waiting for the first or next attempt
+	deliveryDelivered = "delivered" // Webhook responded with 2xx
+	deliveryFailed    = "failed"    // All attempts failed or the webhook rejected the event
+
+	webhookRetryStart = 10 * time.Second
+	webhookRetryMax   = 10 * time.Minute
+	webhookWorkers    = 4
+	webhookQueueSize  = 1000
+
+	webhookSignatureHeader = "X-Habitscheduler-Signature"
+	webhookTimestampHeader = "X-Habitscheduler-Timestamp"
+)
+
+// webhook is a receiver configured with --webhook
+type webhook struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+}
+
+// parseWebhook reads a webhook in format URL[#type|type...], the fragment
+// selects the event types sent to the webhook
+func parseWebhook(in string) (webhook, error) {
+	u, err := url.Parse(in)
+	if err != nil {
+		return webhook{}, fmt.Errorf("Invalid webhook URL %q: %s", in, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return webhook{}, fmt.Errorf("Webhook URL %q must use http or https", in)
+	}
+
+	hook := webhook{}
+	if u.Fragment != "" {
+		hook.Events = strings.Split(u.Fragment, "|")
+		if !validEventFilter(hook.Events) {
+			return webhook{}, fmt.Errorf("Webhook %q selects unknown event types, available are: %s", in, strings.Join(eventTypes, ", "))
+		}
+	}
+	u.Fragment = ""
+	hook.URL = u.String()
+
+	return hook, nil
+}
+
+// webhookDelivery is the delivery of an event to a webhook
+type webhookDelivery struct {
+	ID          string     `json:"id"`
+	Webhook     string     `json:"webhook"`
+	EventID     string     `json:"event_id"`
+	EventType   string     `json:"event_type"`
+	Account     string     `json:"account"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	StatusCode  int        `json:"status_code,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Created     time.Time  `json:"created"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+
+	payload []byte
+}
+
+// webhookDispatcher sends the events to all configured webhooks and keeps
+// the last deliveries for the delivery log
+type webhookDispatcher struct {
+	hooks  []webhook
+	secret []byte
+	client *http.Client
+	queue  chan *webhookDelivery
+	stop   chan struct{}
+
+	lock       sync.Mutex
+	deliveries []*webhookDelivery
+}
+
+// webhooks is nil if no webhook is configured
+var webhooks *webhookDispatcher
+
+func newWebhookDispatcher() (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		secret: []byte(config.WebhookSecret),
+		client: &http.Client{Timeout: config.WebhookTimeout},
+		queue:  make(chan *webhookDelivery, webhookQueueSize),
+		stop:   make(chan struct{}),
+	}
+
+	for _, in := range config.Webhooks {
+		if in == "" {
+			continue
+		}
+		hook, err := parseWebhook(in)
+		if err != nil {
+			return nil, err
+		}
+		d.hooks = append(d.hooks, hook)
+	}
+
+	if len(d.hooks) == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// run starts the workers sending the deliveries
+func (d *webhookDispatcher) run() {
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-d.stop:
+					return
+				case delivery := <-d.queue:
+					d.attempt(delivery)
+				}
+			}
+		}()
+	}
+}
+
+// Stop ends the workers, pending deliveries are dropped
+func (d *webhookDispatcher) Stop() {
+	close(d.stop)
+}
+
+// handleEvent is subscribed to the event bus and creates a delivery for
+// every webhook selecting the event type
+func (d *webhookDispatcher) handleEvent(e Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Unable to encode event %s for webhooks: %s", e.ID, err)
+		return
+	}
+
+	for _, hook := range d.hooks {
+		if !eventMatches(hook.Events, e.Type) {
+			continue
+		}
+
+		delivery := &webhookDelivery{
+			ID:        uuid.NewV4().String(),
+			Webhook:   hook.URL,
+			EventID:   e.ID,
+			EventType: e.Type,
+			Account:   e.Account,
+			State:     deliveryPending,
+			Created:   time.Now(),
+			payload:   payload,
+		}
+		d.record(delivery)
+		d.enqueue(delivery)
+	}
+}
+
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		d.lock.Lock()
+		delivery.State = deliveryFailed
+		delivery.LastError = "Delivery queue is full"
+		delivery.NextAttempt = nil
+		d.lock.Unlock()
+
+		log.Printf("Dropped delivery of event %s to webhook %s: queue is full", delivery.EventID, delivery.Webhook)
+		metricWebhookDeliveries.Inc("dropped")
+	}
+}
+
+// record adds the delivery to the log, dropping the oldest deliveries once
+// more than --webhook-log-size are kept
+func (d *webhookDispatcher) record(delivery *webhookDelivery) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.deliveries = append(d.deliveries, delivery)
+	if over := len(d.deliveries) - config.WebhookLogSize; over > 0 {
+		d.deliveries = append([]*webhookDelivery{}, d.deliveries[over:]...)
+	}
+}
+
+// attempt sends the delivery once and schedules a retry if it failed for a
+// reason which might go away
+func (d *webhookDispatcher) attempt(delivery *webhookDelivery) {
+	status, err := d.send(delivery)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttempt = &now
+	delivery.StatusCode = status
+	delivery.NextAttempt = nil
+
+	if err == nil {
+		delivery.State = deliveryDelivered
+		delivery.LastError = ""
+		metricWebhookDeliveries.Inc("delivered")
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if !webhookRetryable(status) {
+		delivery.State = deliveryFailed
+		log.Printf("Webhook %s rejected event %s: %s", delivery.Webhook, delivery.EventID, err)
+		metricWebhookDeliveries.Inc("failed")
+		return
+	}
+	if delivery.Attempts > config.WebhookRetries {
+		delivery.State = deliveryFailed
+		log.Printf("Giving up delivery of event %s to webhook %s after %d attempts: %s", delivery.EventID, delivery.Webhook, delivery.Attempts, err)
+		metricWebhookDeliveries.Inc("failed")
+		return
+	}
+
+	delay := webhookRetryDelay(delivery.Attempts)
+	next := now.Add(delay)
+	delivery.NextAttempt = &next
+	metricWebhookDeliveries.Inc("retry")
+
+	time.AfterFunc(delay, func() {
+		select {
+		case <-d.stop:
+		default:
+			d.enqueue(delivery)
+		}
+	})
+}
+
+// send posts the payload signed with --webhook-secret. The signature is the
+// hex encoded HMAC-SHA256 of the timestamp header, a dot and the body.
+func (d *webhookDispatcher) send(delivery *webhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", delivery.Webhook, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "habitscheduler/"+version)
+	req.Header.Set("X-Habitscheduler-Event", delivery.EventType)
+	req.Header.Set("X-Habitscheduler-Delivery", delivery.ID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	if len(d.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(d.secret, timestamp, delivery.payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func signWebhookPayload(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryable reports whether a delivery failed with the status is
+// retried: transport errors (status 0), timeouts, rate limits and server
+// errors are, other responses won't change by sending the event again
+func webhookRetryable(status int) bool {
+	switch {
+	case status == 0:
+		return true
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return true
+	case status >= 500:
+		return true
+	}
+	return false
+}
+
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryStart
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > webhookRetryMax {
+		return webhookRetryMax
+	}
+	return delay
+}
+
+func handleGetWebhooks(res http.ResponseWriter, r *http.Request) {
+	hooks := []webhook{}
+	if webhooks != nil {
+		hooks = webhooks.hooks
+	}
+
+	data, _ := json.Marshal(hooks)
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(data)
+}
+
+// handleGetWebhookDeliveries lists the delivery log, newest first, filtered
+// by the state, event_type and account query parameters
+func handleGetWebhookDeliveries(res http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	deliveries := []webhookDelivery{}
+
+	if webhooks != nil {
+		webhooks.lock.Lock()
+		for i := len(webhooks.deliveries) - 1; i >= 0; i-- {
+			d := webhooks.deliveries[i]
+			if (q.Get("state") != "" && d.State != q.Get("state")) ||
+				(q.Get("event_type") != "" && d.EventType != q.Get("event_type")) ||
+				(q.Get("account") != "" && d.Account != q.Get("account")) {
+				continue
+			}
+			deliveries = append(deliveries, *d)
+		}
+		webhooks.lock.Unlock()
+	}
+
+	data, _ := json.Marshal(deliveries)
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(data)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookAttemptRetries(t *testing.T) {
+	withConfig(t, func(c *configuration) { c.WebhookRetries = 5 })
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, c := range []struct {
+		name   string
+		status int
+		state  string
+	}{
+		{"delivered", http.StatusNoContent, deliveryDelivered},
+		{"transport error", 0, deliveryPending},
+		{"timeout", http.StatusRequestTimeout, deliveryPending},
+		{"rate limited", http.StatusTooManyRequests, deliveryPending},
+		{"server error", http.StatusInternalServerError, deliveryPending},
+		{"unavailable", http.StatusServiceUnavailable, deliveryPending},
+		{"bad request", http.StatusBadRequest, deliveryFailed},
+		{"unauthorized", http.StatusUnauthorized, deliveryFailed},
+		{"not found", http.StatusNotFound, deliveryFailed},
+		{"gone", http.StatusGone, deliveryFailed},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			url := closed.URL
+			if c.status != 0 {
+				srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+					res.WriteHeader(c.status)
+				}))
+				t.Cleanup(srv.Close)
+				url = srv.URL
+			}
+
+			d := &webhookDispatcher{
+				client: &http.Client{Timeout: time.Second},
+				queue:  make(chan *webhookDelivery, 1),
+				stop:   make(chan struct{}),
+			}
+			t.Cleanup(d.Stop)
+
+			delivery := &webhookDelivery{Webhook: url, State: deliveryPending, payload: []byte("{}")}
+			d.attempt(delivery)
+
+			if delivery.State != c.state || delivery.StatusCode != c.status {
+				t.Errorf("Delivery is %s with status %d, want %s with %d", delivery.State, delivery.StatusCode, c.state, c.status)
+			}
+			if retry := delivery.NextAttempt != nil; retry != (c.state == deliveryPending) {
+				t.Errorf("Retry scheduled: %v", retry)
+			}
+		})
+	}
+}
+
+func TestWebhookAttemptGivesUp(t *testing.T) {
+	withConfig(t, func(c *configuration) { c.WebhookRetries = 2 })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		res.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(srv.Close)
+
+	d := &webhookDispatcher{
+		client: srv.Client(),
+		queue:  make(chan *webhookDelivery, 1),
+		stop:   make(chan struct{}),
+	}
+	t.Cleanup(d.Stop)
+
+	delivery := &webhookDelivery{Webhook: srv.URL, State: deliveryPending, payload: []byte("{}")}
+	for i := 0; i < 3; i++ {
+		if delivery.State != deliveryPending {
+			t.Fatalf("Delivery is %s after %d attempts", delivery.State, i)
+		}
+		d.attempt(delivery)
+	}
+	if delivery.State != deliveryFailed || delivery.NextAttempt != nil {
+		t.Errorf("Delivery is %s after the retries were used up", delivery.State)
+	}
+}